@@ -1,233 +1,6569 @@
 package main
 
 import (
+	"archive/tar"
+	"archive/zip"
+	"bufio"
+	"bytes"
+	"cmp"
+	"compress/flate"
+	"compress/gzip"
+	"container/list"
 	"context"
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
 	"flag"
 	"fmt"
+	"hash"
+	"hash/crc32"
+	"html"
 	"io"
+	"io/fs"
 	"log"
+	"math"
+	"mime"
+	"net"
 	"net/http"
+	"net/netip"
+	"net/url"
 	"os"
 	"os/signal"
+	"path"
 	"path/filepath"
+	"runtime"
+	"runtime/debug"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"syscall"
+	"time"
+	"unicode/utf8"
+)
+
+// Build metadata, set with -ldflags "-X main.version=... -X main.commit=..."
+var (
+	version = "dev"
+	commit  = ""
 )
 
 func main() {
+	a := setup(flag.CommandLine, os.Args[1:])
+	if a == nil {
+		return
+	}
+	srv := http.Server{
+		Handler: a.handler,
+	}
+
+	quit := make(chan os.Signal, 1)
+	signal.Notify(quit, syscall.SIGINT, syscall.SIGTERM)
+
+	toggle := make(chan os.Signal, 1)
+	notifyToggle(toggle)
+	go func() {
+		for range toggle {
+			on := !a.maintenance.Load()
+			a.maintenance.Store(on)
+			log.Printf("Maintenance mode: %t\n", on)
+		}
+	}()
+
+	go func() {
+		<-quit
+		log.Println("Shutting down...")
+		if err := srv.Shutdown(context.Background()); err != nil {
+			log.Fatal(err)
+		}
+	}()
+
+	listeners, err := listenAll(a.addrs, a.keepAlive, a.reusePort)
+	if err != nil {
+		log.Fatal(err)
+	}
+	go waitForPrefix(a.dirPrefix, a.ready)
+
+	// All listeners share one server so Shutdown drains every one of them
+	errs := make(chan error, len(listeners))
+	for _, ln := range listeners {
+		log.Printf("Starting server on %s...\n", ln.Addr())
+		go func(ln net.Listener) {
+			err := srv.Serve(ln)
+			if err != nil && err != http.ErrServerClosed {
+				err = fmt.Errorf("listener %s: %w", ln.Addr(), err)
+				// Take the remaining listeners down with the failed one
+				_ = srv.Close()
+			} else {
+				err = nil
+			}
+			errs <- err
+		}(ln)
+	}
+
+	var serveErrs []error
+	for range listeners {
+		if err := <-errs; err != nil {
+			serveErrs = append(serveErrs, err)
+		}
+	}
+	a.close()
+	if err := errors.Join(serveErrs...); err != nil {
+		log.Fatal(err)
+	}
+}
+
+// app is the server setup builds from its flags, ready to be put on its
+// listeners.
+type app struct {
+	handler     http.Handler
+	addrs       []string
+	dirPrefix   string
+	keepAlive   time.Duration
+	reusePort   bool
+	ready       *atomic.Bool
+	maintenance *atomic.Bool
+	audit       *auditLog
+	// stop is closed to end the background loops setup started
+	stop chan struct{}
+}
+
+// close releases what setup opened. It is called once the servers have
+// shut down, as requests still in flight may write to the audit log.
+func (a *app) close() {
+	close(a.stop)
+	if err := a.audit.Close(); err != nil {
+		log.Printf("Error closing audit log: %v\n", err)
+	}
+}
+
+// setup parses args into flags and builds the server they describe. It
+// returns nil when there is nothing to serve, as with -version.
+func setup(flags *flag.FlagSet, args []string) *app {
+	var showVersion bool
 	var dirPrefix string
-	flag.StringVar(&dirPrefix, "prefix", ".", "Directory prefix for all operations")
-	flag.Parse()
+	var listenAddrs string
+	var basePath string
+	var hideTemp bool
+	var tempPatterns string
+	var casMode bool
+	var zipPrebuildMax int64
+	var listingLimit int
+	var listingTimeout time.Duration
+	var maxListingBytes int64
+	var groupDirs bool
+	var listingCacheControl string
+	var extraHeaders headerFlags
+	var secureHeaders bool
+	var csp string
+	var auditFile string
+	var ignoreFile string
+	var accessLogJSON bool
+	var fetch fetchPolicy
+	var maxDiskUsage int64
+	var metricsOn bool
+	var safeMode bool
+	var multipartMem int64
+	var gzipOn bool
+	var gzipMinSize int64
+	var tcpKeepAlive time.Duration
+	var defaultCharset string
+	var noUpload, noDelete bool
+	var cacheControl cacheRules
+	var mimeTypes mimeOverrides
+	var mimeTypesFile string
+	var tempDir string
+	var defaultSort string
+	var mobileListing bool
+	var createPrefix bool
+	var zipLevel int
+	var zipWorkers int
+	var compressWorkers int
+	var slowThreshold time.Duration
+	var dirManifest string
+	var onConflict string
+	var maxWalkDepth int
+	var robotsFile string
+	var denyServeExt string
+	var uploadEvents bool
+	var reusePort bool
+	var logsEndpoint bool
+	var partTTL time.Duration
+	var uploadDir string
+	var eventURL string
+	var asyncDelete bool
+	var methodOverride bool
+	var readCacheDir string
+	var serverTimingOn bool
+	var fallbackPage string
+	var readAllow, writeAllow cidrList
+	var listingIcons bool
+	var backendCheck time.Duration
+	var readCacheSize int64
+	var uploadQuota, downloadQuota int64
+	var quotaWindow time.Duration
+	var logsBuffer int
+	var fetchHosts, fetchSchemes string
+	var htpasswdFile string
+	var userHomes bool
+	var maxUpload int64
+	var maintenanceOn bool
+	var maintenanceMessage string
+	var maintenanceRetry time.Duration
+	flags.BoolVar(&showVersion, "version", false, "Print version information and exit")
+	flags.StringVar(&dirPrefix, "prefix", ".", "Directory prefix for all operations")
+	flags.StringVar(&listenAddrs, "addr", ":8080", "Comma-separated list of addresses to listen on")
+	flags.StringVar(&basePath, "base-path", "", "URL path prefix the server is mounted under, e.g. /files")
+	flags.BoolVar(&hideTemp, "hide-temp", false, "Hide temp and zero-byte files from directory listings")
+	flags.StringVar(&tempPatterns, "temp-patterns", "*.part,*.tmp", "Comma-separated glob patterns treated as temp files")
+	flags.BoolVar(&casMode, "cas", false, "Store uploads as content-addressed blobs under <prefix>/.cas")
+	flags.StringVar(&htpasswdFile, "htpasswd", "", "htpasswd-style credentials file; enables basic auth")
+	flags.BoolVar(&userHomes, "user-homes", false, "Scope each authenticated user to <prefix>/<username> (requires -htpasswd)")
+	flags.Int64Var(&maxUpload, "max-upload", 0, "Maximum upload request body size in bytes (0 for unlimited)")
+	flags.BoolVar(&maintenanceOn, "maintenance", false, "Start in maintenance mode (toggle at runtime with SIGUSR1)")
+	flags.StringVar(&maintenanceMessage, "maintenance-message", "Down for maintenance", "Message returned while in maintenance mode")
+	flags.DurationVar(&maintenanceRetry, "maintenance-retry-after", 5*time.Minute, "Retry-After sent while in maintenance mode")
+	flags.IntVar(&listingLimit, "listing-limit", 0, "Maximum number of entries rendered in a listing (0 for unlimited)")
+	flags.Int64Var(&maxListingBytes, "max-listing-bytes", 0, "Entries a listing response may spend this many bytes on before the rest are cut off as truncated (0 for unlimited)")
+	flags.DurationVar(&listingTimeout, "listing-timeout", 0, "How long reading a directory may take before the entries read so far are listed as partial (0 for no limit)")
+	flags.Var(&extraHeaders, "header", `Response header "Key: Value" added to every response (repeatable)`)
+	flags.BoolVar(&secureHeaders, "secure-headers", false, "Send a baseline of hardening headers on every response")
+	flags.StringVar(&csp, "csp", defaultCSP, "Content-Security-Policy sent with -secure-headers")
+	flags.BoolVar(&groupDirs, "group-dirs", true, "List directories before files, each sorted by name")
+	flags.StringVar(&listingCacheControl, "listing-cache-control", "no-cache", "Cache-Control sent with directory listings (empty to omit)")
+	flags.StringVar(&auditFile, "audit-log", "", "Append a JSON-lines audit record of every mutating operation to this file")
+	flags.StringVar(&ignoreFile, "ignore-file", ".gopiignore", "Name of per-directory files listing glob patterns to hide (empty to disable)")
+	flags.BoolVar(&accessLogJSON, "access-log-json", false, "Write one JSON access log object per request to stdout")
+	flags.StringVar(&fetchHosts, "fetch-allow-hosts", "", "Comma-separated hosts (or *.domain) that ?action=fetch may download from; empty disables fetching")
+	flags.StringVar(&fetchSchemes, "fetch-allow-schemes", "https", "Comma-separated URL schemes ?action=fetch may use")
+	flags.Int64Var(&fetch.maxSize, "fetch-max-size", 1<<30, "Maximum size in bytes of a server-side fetch")
+	flags.DurationVar(&fetch.timeout, "fetch-timeout", 10*time.Minute, "Timeout for a server-side fetch")
+	flags.Int64Var(&maxDiskUsage, "max-disk-usage", 0, "Reject uploads once the prefix holds this many bytes (0 for unlimited)")
+	flags.BoolVar(&metricsOn, "metrics", false, "Expose Prometheus metrics at /metrics")
+	flags.BoolVar(&safeMode, "safe-mode", false, "Resolve symlinks and refuse any path whose real location is outside the prefix")
+	flags.Int64Var(&zipPrebuildMax, "zip-prebuild-max", 64<<20, "Directories up to this many bytes are zipped to a temp file first so downloads can resume (0 always streams)")
+	flags.BoolVar(&reusePort, "reuseport", false, "Set SO_REUSEPORT so several processes can share the listen port during restarts (Linux and BSDs)")
+	flags.BoolVar(&uploadEvents, "upload-events", false, "Stream progress of uploads sent with X-Upload-Id as server-sent events at /uploads/{id}/events")
+	flags.StringVar(&denyServeExt, "deny-serve-ext", "", "Comma-separated file extensions refused with 403 on GET, e.g. .env,.key")
+	flags.StringVar(&robotsFile, "robots", "", "File served as /robots.txt instead of the built-in disallow-all, or \"off\" to serve the prefix's own")
+	flags.IntVar(&maxWalkDepth, "max-walk-depth", 0, "Deepest directory level recursive operations (ZIP, tar.gz, manifest) descend to (0 for no limit)")
+	flags.StringVar(&onConflict, "on-conflict", "reject", "What an upload to an existing name does: reject (409) or rename to \"name (N).ext\"")
+	flags.StringVar(&dirManifest, "dir-manifest", ".gopi.json", "Name of per-directory JSON files setting response headers for files beneath them (empty disables)")
+	flags.DurationVar(&slowThreshold, "slow-threshold", 0, "Log a warning for requests that take longer than this (0 disables)")
+	flags.IntVar(&zipLevel, "zip-level", 6, "Compression level for ZIP and tar.gz downloads, 0 (store) to 9 (smallest)")
+	flags.IntVar(&zipWorkers, "zip-workers", 1, "Files compressed in parallel while building a ZIP download (0 for one per CPU)")
+	flags.IntVar(&compressWorkers, "compress-workers", 0, "Compressions (gzip, ZIP, tar.gz) run at once across all responses; others wait their turn (0 for GOMAXPROCS)")
+	flags.BoolVar(&createPrefix, "create-prefix", false, "Create the prefix directory if it doesn't exist")
+	flags.BoolVar(&listingIcons, "listing-icons", false, "Show an inline SVG icon for each entry's type in HTML listings")
+	flags.BoolVar(&mobileListing, "mobile-listing", false, "Serve a touch-friendly HTML listing to mobile browsers")
+	flags.StringVar(&defaultSort, "default-sort", "name", "Listing order when no ?sort is given: name, modtime or size, optionally suffixed -desc")
+	flags.StringVar(&tempDir, "temp-dir", "", "Directory for upload and multipart temp files (default: beside each uploaded file)")
+	flags.Var(&mimeTypes, "mime", "Content type for a file extension, as \".ext=type\" (repeatable)")
+	flags.StringVar(&mimeTypesFile, "mime-types", "", "mime.types-style file of \"type ext...\" lines to add to the known content types")
+	flags.Var(&cacheControl, "cache-control", "Cache-Control for files matching a glob, as \"glob=directive\" (repeatable, first match wins)")
+	flags.BoolVar(&noUpload, "no-upload", false, "Refuse uploads (PUT and POST) with 405")
+	flags.BoolVar(&noDelete, "no-delete", false, "Refuse deletes and moves with 405")
+	flags.StringVar(&defaultCharset, "default-charset", "utf-8", "Charset added to text/* files whose type doesn't declare one (empty to leave types alone)")
+	flags.DurationVar(&tcpKeepAlive, "tcp-keepalive", 15*time.Second, "TCP keep-alive probe period for accepted connections (0 disables)")
+	flags.BoolVar(&gzipOn, "gzip", false, "Compress responses for clients that accept gzip")
+	flags.Int64Var(&gzipMinSize, "gzip-min-size", 1024, "Responses smaller than this many bytes are sent uncompressed")
+	flags.Int64Var(&multipartMem, "multipart-mem", 10<<20, "Bytes of a multipart upload held in memory before spilling to temp files")
+	flags.BoolVar(&logsEndpoint, "logs-endpoint", false, "Stream the server's own log output at /logs (requires -htpasswd)")
+	flags.IntVar(&logsBuffer, "logs-buffer", 1000, "Number of recent log lines /logs replays before following new ones")
+	flags.Int64Var(&uploadQuota, "per-ip-upload-quota", 0, "Bytes each client IP may upload per -quota-window before getting 429 (0 for unlimited)")
+	flags.Int64Var(&downloadQuota, "per-ip-download-quota", 0, "Bytes each client IP may download per -quota-window before getting 429 (0 for unlimited)")
+	flags.DurationVar(&quotaWindow, "quota-window", time.Hour, "Sliding window the per-IP byte quotas are measured over")
+	flags.Var(&readAllow, "allow-cidr", "CIDR allowed to read (GET, HEAD, OPTIONS); may be repeated or comma-separated (default: any address)")
+	flags.Var(&writeAllow, "upload-allow-cidr", "CIDR allowed to upload, delete or otherwise write; may be repeated or comma-separated (default: any address)")
+	flags.StringVar(&fallbackPage, "fallback-page", "", "HTML page served with 503 while the prefix can't be read, e.g. during a storage outage")
+	flags.DurationVar(&backendCheck, "backend-check-interval", 5*time.Second, "How often -fallback-page checks whether the prefix is readable")
+	flags.BoolVar(&verboseErrors, "verbose-errors", false, "Include the underlying cause in error messages sent to clients (for development)")
+	flags.BoolVar(&serverTimingOn, "server-timing", false, "Send Server-Timing headers breaking down where each request spent its time")
+	flags.StringVar(&readCacheDir, "read-cache-dir", "", "Local directory caching files read from a slow prefix, such as a network mount (empty disables)")
+	flags.Int64Var(&readCacheSize, "read-cache-size", 1<<30, "Bytes the read cache may hold before evicting the least recently used files")
+	flags.BoolVar(&methodOverride, "method-override", false, "Let a POST act as PUT or DELETE through X-HTTP-Method-Override, or as DELETE through a _method field in a same-origin form, for clients limited to GET and POST")
+	flags.BoolVar(&asyncDelete, "async-delete", false, "Let DELETE of a directory with Prefer: respond-async run in the background, with progress at /jobs/{id}")
+	flags.StringVar(&eventURL, "upload-event-url", "", "Publish upload-complete events to nats://host:port/subject or redis://[:password@]host:port/stream")
+	flags.StringVar(&uploadDir, "upload-dir", "", "Subdirectory of the prefix (of each home with -user-homes) that uploads are confined to; others get 403")
+	flags.DurationVar(&partTTL, "part-ttl", 0, "Remove resumable upload .part files that haven't grown for this long (0 keeps them)")
+	if err := flags.Parse(args); err != nil {
+		log.Fatal(err)
+	}
+
+	if showVersion {
+		fmt.Printf("gopi %s (commit %s, %s)\n", version, buildCommit(), runtime.Version())
+		return nil
+	}
+
+	// Capture from the start so startup messages are replayed too
+	var logs *logRing
+	if logsEndpoint {
+		if logsBuffer <= 0 {
+			log.Fatal("-logs-buffer must be positive")
+		}
+		logs = newLogRing(logsBuffer)
+		log.SetOutput(io.MultiWriter(os.Stderr, logs))
+	}
+
+	if onConflict != "reject" && onConflict != "rename" {
+		log.Fatal("-on-conflict must be reject or rename")
+	}
+	if zipLevel < 0 || zipLevel > 9 {
+		log.Fatal("-zip-level must be between 0 and 9")
+	}
+	if zipWorkers < 0 {
+		log.Fatal("-zip-workers must not be negative")
+	} else if zipWorkers == 0 {
+		zipWorkers = runtime.NumCPU()
+	}
+	if compressWorkers < 0 {
+		log.Fatal("-compress-workers must not be negative")
+	} else if compressWorkers == 0 {
+		compressWorkers = runtime.GOMAXPROCS(0)
+	}
+	compressPool = newWorkerPool(compressWorkers)
+	if multipartMem <= 0 {
+		log.Fatal("-multipart-mem must be positive")
+	}
+	if uploadQuota < 0 || downloadQuota < 0 {
+		log.Fatal("Per-IP quotas must not be negative")
+	}
+	if (uploadQuota > 0 || downloadQuota > 0) && quotaWindow < time.Second {
+		log.Fatal("-quota-window must be at least 1s")
+	}
+
+	// Registered before anything is served; -mime wins over the file
+	if mimeTypesFile != "" {
+		fromFile, err := loadMimeTypes(mimeTypesFile)
+		if err != nil {
+			log.Fatalf("Unable to load mime types file: %v", err)
+		}
+		for ext, ctype := range fromFile {
+			if _, ok := mimeTypes[ext]; !ok {
+				if err := mimeTypes.Set(ext + "=" + ctype); err != nil {
+					log.Printf("Warning: skipping %s in %s: %v\n", ext, mimeTypesFile, err)
+				}
+			}
+		}
+	}
+	for ext, ctype := range mimeTypes {
+		if err := mime.AddExtensionType(ext, ctype); err != nil {
+			log.Fatalf("Unable to register type for %s: %v", ext, err)
+		}
+	}
+
+	if err := sortListing(nil, defaultSort, false); err != nil {
+		log.Fatalf("Invalid -default-sort %q", defaultSort)
+	}
+
+	if tempDir != "" {
+		probe, err := os.CreateTemp(tempDir, ".gopi-check-*")
+		if err != nil {
+			log.Fatalf("Temp dir is not writable: %v", err)
+		}
+		probe.Close()
+		os.Remove(probe.Name())
+		// The multipart parser spills through os.TempDir
+		os.Setenv("TMPDIR", tempDir)
+	}
+
+	basePath = strings.TrimSuffix(path.Clean("/"+basePath), "/")
+
+	deniedExts := map[string]bool{}
+	for _, ext := range splitList(denyServeExt) {
+		if !strings.HasPrefix(ext, ".") {
+			ext = "." + ext
+		}
+		deniedExts[strings.ToLower(ext)] = true
+	}
+
+	// allow is advertised whenever a method is refused
+	methods := []string{http.MethodGet, http.MethodHead}
+	if !noUpload {
+		methods = append(methods, http.MethodPut, http.MethodPost)
+	}
+	if !noDelete {
+		methods = append(methods, http.MethodDelete)
+	}
+	allow := strings.Join(methods, ", ")
+
+	if createPrefix {
+		if err := os.MkdirAll(dirPrefix, 0755); err != nil {
+			log.Fatalf("Unable to create prefix directory: %v", err)
+		}
+	}
+	if info, err := os.Stat(dirPrefix); err != nil {
+		log.Fatalf("Prefix directory is not usable: %v", err)
+	} else if !info.IsDir() {
+		log.Fatalf("Prefix %s is not a directory", dirPrefix)
+	}
+
+	if safeMode {
+		// Containment checks compare against the prefix's real location
+		canonical, err := filepath.Abs(dirPrefix)
+		if err == nil {
+			canonical, err = filepath.EvalSymlinks(canonical)
+		}
+		if err != nil {
+			log.Fatalf("Unable to resolve prefix for safe mode: %v", err)
+		}
+		dirPrefix = canonical
+	}
+
+	uploadDir = path.Clean("/" + uploadDir)
+	if uploadDir != "/" {
+		// Symlinks must not carry the drop area outside the prefix
+		canonical, err := filepath.Abs(dirPrefix)
+		if err == nil {
+			canonical, err = filepath.EvalSymlinks(canonical)
+		}
+		if err == nil {
+			_, err = resolvePath(canonical, uploadDir, true)
+		}
+		if err != nil {
+			log.Fatalf("Upload dir %s is not inside the prefix: %v", uploadDir, err)
+		}
+	}
+
+	if secureHeaders {
+		// Explicit -header values take precedence over the baseline
+		baseline := map[string]string{
+			"X-Content-Type-Options":  "nosniff",
+			"X-Frame-Options":         "DENY",
+			"Referrer-Policy":         "no-referrer",
+			"Content-Security-Policy": csp,
+		}
+		for key, value := range baseline {
+			if extraHeaders.header.Get(key) == "" && value != "" {
+				_ = extraHeaders.Set(key + ": " + value)
+			}
+		}
+	}
+
+	fetch.hosts = splitList(fetchHosts)
+	fetch.schemes = splitList(fetchSchemes)
+
+	tempGlobs := splitList(tempPatterns)
+	for _, pattern := range tempGlobs {
+		if _, err := filepath.Match(pattern, ""); err != nil {
+			log.Fatalf("Invalid temp pattern %q: %v", pattern, err)
+		}
+	}
+
+	var users htpasswd
+	if htpasswdFile != "" {
+		var err error
+		users, err = loadHtpasswd(htpasswdFile)
+		if err != nil {
+			log.Fatalf("Unable to load htpasswd file: %v", err)
+		}
+	}
+	if logs != nil && users == nil {
+		log.Fatal("-logs-endpoint requires -htpasswd")
+	}
+	if userHomes {
+		if users == nil {
+			log.Fatal("-user-homes requires -htpasswd")
+		}
+		for name := range users {
+			if err := os.MkdirAll(filepath.Join(dirPrefix, name), 0755); err != nil {
+				log.Fatalf("Unable to create home directory for %s: %v", name, err)
+			}
+		}
+	}
+
+	usage := &diskUsage{root: dirPrefix, limit: maxDiskUsage}
+
+	// resolverFor returns the path resolver for the request's root, which
+	// every handler goes through before touching the filesystem
+	resolverFor := func(r *http.Request) pathResolver {
+		root := filepath.Join(dirPrefix, homeName(r, userHomes))
+		return func(rel string) (string, error) {
+			p, err := resolvePath(root, rel, safeMode)
+			if err == nil && isInternalPath(dirPrefix, p) {
+				return "", errInternalPath
+			}
+			return p, err
+		}
+	}
+	// uploadResolverFor is resolverFor for paths an upload writes to
+	uploadResolverFor := func(r *http.Request) pathResolver {
+		return refuseManifest(restrictResolver(resolverFor(r), uploadDir), dirManifest)
+	}
+	stats := newMetrics()
+	checksums := &checksumCache{sums: make(map[string]cachedChecksum)}
+
+	var reads *readCache
+	if readCacheDir != "" {
+		if readCacheSize <= 0 {
+			log.Fatal("-read-cache-size must be positive")
+		}
+		var err error
+		if reads, err = newReadCache(readCacheDir, readCacheSize); err != nil {
+			log.Fatalf("Unable to set up read cache: %v", err)
+		}
+	}
+
+	var notifier *uploadNotifier
+	if eventURL != "" {
+		pub, err := newEventPublisher(eventURL)
+		if err != nil {
+			log.Fatalf("Invalid -upload-event-url: %v", err)
+		}
+		notifier = newUploadNotifier(pub, checksums)
+	}
+
+	var ignore *ignoreSet
+	if ignoreFile != "" {
+		ignore = newIgnoreSet(dirPrefix, ignoreFile)
+	}
+
+	// hidden leaves gopi's own state out of listings and archives along
+	// with what the ignore files hide
+	hidden := func(p string) bool {
+		return isInternalPath(dirPrefix, p) || ignore.hidden(p)
+	}
+	walker := treeWalker{hidden: hidden, maxDepth: maxWalkDepth}
+
+	var manifests *dirManifests
+	if dirManifest != "" {
+		manifests = newDirManifests(dirPrefix, dirManifest)
+	}
+
+	// Background loops run until the app is closed
+	stop := make(chan struct{})
+
+	var audit *auditLog
+	if auditFile != "" {
+		var err error
+		audit, err = openAuditLog(auditFile)
+		if err != nil {
+			log.Fatalf("Unable to open audit log: %v", err)
+		}
+	}
+
+	var cas *casStore
+	if casMode {
+		var err error
+		cas, err = openCASStore(filepath.Join(dirPrefix, casDirName))
+		if err != nil {
+			log.Fatalf("Unable to open content-addressable store: %v", err)
+		}
+	}
+
+	// ready flips to true once the prefix is readable and the listener is bound
+	var ready atomic.Bool
+
+	var maintenance atomic.Bool
+	maintenance.Store(maintenanceOn)
 
 	mux := http.NewServeMux()
 	mux.HandleFunc("GET /readyz", func(w http.ResponseWriter, r *http.Request) {
-		w.WriteHeader(http.StatusOK)
-		_, _ = w.Write([]byte("ok"))
+		if !ready.Load() {
+			writeHealth(w, r, http.StatusServiceUnavailable, "prefix-ready", "Not ready", nil)
+			return
+		}
+		writeHealth(w, r, http.StatusOK, "", "", nil)
+	})
+
+	spec := openAPISpec(apiFeatures{
+		Version:   version,
+		BasePath:  basePath,
+		Upload:    !noUpload,
+		Delete:    !noDelete,
+		Metrics:   metricsOn,
+		BasicAuth: users != nil,
 	})
+	mux.HandleFunc("GET /openapi.json", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(spec)
+	})
+
+	var progress *uploadProgress
+	if uploadEvents {
+		progress = newUploadProgress()
+		mux.HandleFunc("GET /uploads/{id}/events", func(w http.ResponseWriter, r *http.Request) {
+			// The upload may not have started yet when the page subscribes
+			key := homeName(r, userHomes) + "/" + r.PathValue("id")
+			state := progress.wait(r.Context(), key, 5*time.Second)
+			if state == nil {
+				http.Error(w, "Unknown upload", http.StatusNotFound)
+				return
+			}
+			streamProgress(w, r, state)
+		})
+	}
+
+	if logs != nil {
+		mux.HandleFunc("GET /logs", func(w http.ResponseWriter, r *http.Request) {
+			streamLogs(w, r, logs)
+		})
+	}
+
+	var jobs *deleteJobs
+	if asyncDelete {
+		jobs = newDeleteJobs()
+		mux.HandleFunc("GET /jobs/{id}", func(w http.ResponseWriter, r *http.Request) {
+			job := jobs.get(homeName(r, userHomes) + "/" + r.PathValue("id"))
+			if job == nil {
+				http.Error(w, "Unknown job", http.StatusNotFound)
+				return
+			}
+			w.Header().Set("Cache-Control", "no-store")
+			w.Header().Set("Content-Type", "application/json")
+			_ = json.NewEncoder(w).Encode(job.status())
+		})
+	}
+
+	// robots.txt keeps crawlers out by default, whatever the prefix holds
+	if robotsFile != "off" {
+		robots := []byte(defaultRobots)
+		if robotsFile != "" {
+			var err error
+			if robots, err = os.ReadFile(robotsFile); err != nil {
+				log.Fatalf("Unable to read robots file: %v", err)
+			}
+		}
+		mux.HandleFunc("GET /robots.txt", func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+			_, _ = w.Write(robots)
+		})
+	}
 
 	mux.HandleFunc("GET /livez", func(w http.ResponseWriter, r *http.Request) {
 		// Try to read the directory to verify we have access
 		_, err := os.ReadDir(dirPrefix)
 		if err != nil {
 			log.Printf("Liveness check failed: %v\n", err)
-			http.Error(w, "Cannot read directory", http.StatusInternalServerError)
+			writeHealth(w, r, http.StatusInternalServerError, "directory-read", "Cannot read directory", err)
 			return
 		}
 
-		w.WriteHeader(http.StatusOK)
-		_, _ = w.Write([]byte("ok"))
+		writeHealth(w, r, http.StatusOK, "", "", nil)
+	})
+
+	if metricsOn {
+		mux.HandleFunc("GET /metrics", func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+			stats.writeTo(w)
+		})
+	}
+
+	mux.HandleFunc("GET /_cas", func(w http.ResponseWriter, r *http.Request) {
+		if cas == nil {
+			http.Error(w, "Content-addressable storage is disabled", http.StatusNotFound)
+			return
+		}
+		home := homeName(r, userHomes)
+		names := []string{}
+		for _, name := range cas.names() {
+			if home != "" && !strings.HasPrefix(name, home+"/") {
+				continue
+			}
+			if !hidden(filepath.Join(dirPrefix, filepath.FromSlash(name))) {
+				names = append(names, name)
+			}
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(names)
 	})
 
 	mux.HandleFunc("GET /", func(w http.ResponseWriter, r *http.Request) {
-		path := filepath.Join(dirPrefix, r.URL.Path)
+		if cas != nil {
+			key := casKey(path.Join(homeName(r, userHomes), r.URL.Path))
+			if entry, ok := cas.lookup(key); ok {
+				// Logical names get the same screening as files on disk
+				if deniedExts[strings.ToLower(path.Ext(key))] {
+					http.Error(w, "Forbidden", http.StatusForbidden)
+					return
+				}
+				if hidden(filepath.Join(dirPrefix, filepath.FromSlash(key))) {
+					http.Error(w, "File not found", http.StatusNotFound)
+					return
+				}
+				stats.countDownload(w, func(w http.ResponseWriter) { cas.serve(w, r, entry) })
+				return
+			}
+		}
+
+		if r.URL.Query().Has("quota") {
+			used, err := usage.current()
+			if err != nil {
+				log.Printf("Error computing disk usage: %v\n", err)
+				http.Error(w, "Unable to compute disk usage", http.StatusInternalServerError)
+				return
+			}
+			report := quotaReport{Used: used}
+			if maxDiskUsage > 0 {
+				available := max(maxDiskUsage-used, 0)
+				report.MaxDiskUsage = &maxDiskUsage
+				report.Available = &available
+			}
+			w.Header().Set("Content-Type", "application/json")
+			_ = json.NewEncoder(w).Encode(report)
+			return
+		}
+
+		timing := timingFrom(r.Context())
+		statDone := timing.track("stat")
+		path, err := resolverFor(r)(r.URL.Path)
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+		if ignore.hidden(path) {
+			http.Error(w, "File not found", http.StatusNotFound)
+			return
+		}
 
 		f, err := os.Open(path)
 		if err != nil {
+			if os.IsPermission(err) {
+				http.Error(w, "Permission denied", http.StatusForbidden)
+				return
+			}
 			http.Error(w, "File not found", http.StatusNotFound)
 			return
 		}
 		defer f.Close()
 
 		fileInfo, err := f.Stat()
+		statDone()
 		if err != nil {
 			http.Error(w, "Error getting file info", http.StatusInternalServerError)
 			return
 		}
 
-		if fileInfo.IsDir() {
-			files, err := f.ReadDir(-1)
+		// Relative links only resolve against slash-terminated directory URLs
+		hasSlash := strings.HasSuffix(r.URL.Path, "/")
+		if fileInfo.IsDir() && !hasSlash {
+			redirectPath(w, r, basePath+r.URL.Path+"/")
+			return
+		}
+		if !fileInfo.IsDir() && hasSlash {
+			redirectPath(w, r, basePath+strings.TrimRight(r.URL.Path, "/"))
+			return
+		}
+
+		if !fileInfo.IsDir() && deniedExts[strings.ToLower(filepath.Ext(path))] {
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			return
+		}
+
+		if fileInfo.IsDir() && r.URL.Query().Get("checksum") == "tree" {
+			sum, limited, err := checksums.tree(path, walker)
 			if err != nil {
-				http.Error(w, "Error reading directory", http.StatusInternalServerError)
+				writeError(w, err)
 				return
 			}
-
-			w.Header().Set("Content-Type", "text/html; charset=utf-8")
-			fmt.Fprintf(w, "<!DOCTYPE html>\n")
-			fmt.Fprintf(w, "<html lang=\"en\">\n")
-			fmt.Fprintf(w, "<head>\n")
-			fmt.Fprintf(w, "  <meta charset=\"utf-8\">\n")
-			fmt.Fprintf(w, "  <meta name=\"viewport\" content=\"width=device-width, initial-scale=1\">\n")
-			fmt.Fprintf(w, "  <title>Directory listing for %s</title>\n", path)
-			fmt.Fprintf(w, "</head>\n")
-			fmt.Fprintf(w, "<body>\n")
-			fmt.Fprintf(w, "  <header>\n")
-			fmt.Fprintf(w, "    <h1>Links for %s</h1>\n", path)
-			fmt.Fprintf(w, "  </header>\n")
-			fmt.Fprintf(w, "  <main>\n")
-			fmt.Fprintf(w, "    <ul>\n")
-			for _, file := range files {
-				name := file.Name()
-				if file.IsDir() {
-					name += "/"
-				}
-				fmt.Fprintf(w, "      <li><a href=\"%s\">%s</a></li>\n", filepath.Join(name), name)
+			w.Header().Set("X-Depth-Limited", strconv.FormatBool(limited))
+			if wantsJSON(r) {
+				w.Header().Set("Content-Type", "application/json")
+				_ = json.NewEncoder(w).Encode(map[string]string{"algorithm": "tree", "digest": sum})
+				return
 			}
-			fmt.Fprintf(w, "    </ul>\n")
-			fmt.Fprintf(w, "  </main>\n")
-			fmt.Fprintf(w, "</body>\n")
-			fmt.Fprintf(w, "</html>\n")
-		} else {
-			http.ServeFile(w, r, path)
+			w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+			fmt.Fprintln(w, sum)
+			return
 		}
-	})
 
-	mux.HandleFunc("POST /", func(w http.ResponseWriter, r *http.Request) {
-		err := r.ParseMultipartForm(10 << 20) // 10 MB max memory
-		if err != nil {
-			http.Error(w, "Unable to parse form", http.StatusBadRequest)
+		if fileInfo.IsDir() && r.URL.Query().Get("format") == "zip" {
+			stats.countDownload(w, func(w http.ResponseWriter) {
+				serveZip(w, r, path, zipPrebuildMax, zipLevel, zipWorkers, walker)
+			})
 			return
 		}
 
-		// Check for "name" key and create directory if it exists
-		var dirName string
-		if names, ok := r.MultipartForm.Value["name"]; ok && len(names) > 0 {
-			dirName = names[0]
-			err := os.Mkdir(filepath.Join(dirPrefix, dirName), 0755)
-			if err != nil && !os.IsExist(err) {
-				log.Printf("Error creating directory: %v\n", err)
-				http.Error(w, "Unable to create directory", http.StatusInternalServerError)
-				return
-			}
-			log.Printf("Created directory: %s\n", dirName)
-		} else {
-			http.Error(w, "Directory name not provided", http.StatusBadRequest)
+		if fileInfo.IsDir() && r.URL.Query().Get("format") == "tar.gz" {
+			stats.countDownload(w, func(w http.ResponseWriter) {
+				serveTarGz(w, r, path, zipLevel, walker)
+			})
 			return
 		}
 
-		// Save uploaded files to the created directory
-		for key, files := range r.MultipartForm.File {
-			for _, file := range files {
-				log.Printf("File: %s, Name: %s, Size: %d bytes\n", key, file.Filename, file.Size)
-
-				// Open the uploaded file
-				src, err := file.Open()
+		syncFormat := r.URL.Query().Get("format") == "sync"
+		if fileInfo.IsDir() && (r.URL.Query().Get("manifest") == "1" || syncFormat) {
+			var since time.Time
+			if v := r.URL.Query().Get("since"); v != "" {
+				t, err := time.Parse(time.RFC3339, v)
 				if err != nil {
-					log.Printf("Error opening uploaded file: %v\n", err)
-					continue
+					http.Error(w, "Invalid since timestamp", http.StatusBadRequest)
+					return
 				}
+				since = t
+			}
+			w.Header().Set("Trailer", "X-Depth-Limited")
+			var limited bool
+			if syncFormat {
+				w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+				limited = writeSyncList(w, path, since, walker)
+			} else {
+				w.Header().Set("Content-Type", "application/json")
+				limited = writeManifest(w, path, since, walker, checksums)
+			}
+			w.Header().Set("X-Depth-Limited", strconv.FormatBool(limited))
+			return
+		}
 
-				// Check if the file already exists
-				filePath := filepath.Join(dirPrefix, dirName, file.Filename)
-				log.Printf("Checking if file already exists: %s\n", filePath)
-				if _, err := os.Stat(filePath); err == nil {
-					log.Printf("File already exists: %s\n", filePath)
-					http.Error(w, "File already exists", http.StatusConflict)
-					src.Close()
+		if fileInfo.IsDir() {
+			recursive := r.URL.Query().Get("recursive") == "1"
+			// A listing only changes when the directory itself does, which
+			// doesn't hold for one spanning the whole subtree
+			if !recursive {
+				if listingCacheControl != "" {
+					w.Header().Set("Cache-Control", listingCacheControl)
+				}
+				modTime := fileInfo.ModTime()
+				w.Header().Set("Last-Modified", modTime.UTC().Format(http.TimeFormat))
+				if notModifiedSince(r, modTime) {
+					w.WriteHeader(http.StatusNotModified)
 					return
 				}
+			}
 
-				// Create the destination file
-				dst, err := os.OpenFile(
-					filePath,
-					os.O_WRONLY|os.O_CREATE|os.O_EXCL,
-					0444,
-				)
+			hidingTemp := hideTemp || r.URL.Query().Get("hide-temp") == "1"
+			var entries []listingEntry
+			var partial bool
+			if recursive {
+				readDone := timing.track("read")
+				var limited bool
+				entries, limited = recursiveEntries(path, walker, func(file os.DirEntry) bool {
+					return !hidingTemp || !isTempFile(file, tempGlobs)
+				})
+				readDone()
+				w.Header().Set("X-Depth-Limited", strconv.FormatBool(limited))
+			} else {
+				readDone := timing.track("read")
+				files, err := readDirTimeout(r.Context(), f, listingTimeout)
+				readDone()
+				if errors.Is(err, context.DeadlineExceeded) {
+					if len(files) == 0 {
+						http.Error(w, "Timed out reading directory", http.StatusGatewayTimeout)
+						return
+					}
+					// What's missing may turn up on the next try
+					partial, err = true, nil
+					w.Header().Set("X-Listing-Partial", "true")
+					w.Header().Set("Cache-Control", "no-store")
+					w.Header().Del("Last-Modified")
+				}
 				if err != nil {
-					log.Printf("Error creating destination file: %v\n", err)
-					http.Error(w, "Unable to create file", http.StatusInternalServerError)
-					src.Close()
+					// The directory may have been deleted since it was opened
+					if _, statErr := os.Stat(path); errors.Is(err, fs.ErrNotExist) || errors.Is(statErr, fs.ErrNotExist) {
+						http.Error(w, "File not found", http.StatusNotFound)
+						return
+					}
+					http.Error(w, "Error reading directory", http.StatusInternalServerError)
 					return
 				}
 
-				// Copy the uploaded file to the destination file
-				writtenSize, err := io.Copy(dst, src)
-				src.Close()
-				dst.Close()
-				if err != nil || writtenSize != file.Size {
-					log.Printf("Error copying file: %v\n", err)
-					// Delete the partially written file
-					removeErr := os.Remove(filePath)
-					if removeErr != nil {
-						log.Printf("Error removing partial file: %v\n", removeErr)
+				if hidingTemp {
+					files = filterTempFiles(files, tempGlobs)
+				}
+
+				visible := files[:0]
+				for _, file := range files {
+					if !hidden(filepath.Join(path, file.Name())) {
+						visible = append(visible, file)
 					}
-					http.Error(w, "Error copying file", http.StatusInternalServerError)
+				}
+				files = visible
+
+				entries = newListingEntries(files)
+			}
+			addSidecarChecksums(path, entries)
+
+			if since := r.URL.Query().Get("modified-since"); since != "" {
+				t, err := time.Parse(time.RFC3339, since)
+				if err != nil {
+					http.Error(w, "Invalid modified-since timestamp", http.StatusBadRequest)
 					return
 				}
-				log.Printf("File saved: %s\n", filePath)
+				entries = filterModifiedSince(entries, t)
 			}
-		}
 
-		w.WriteHeader(http.StatusOK)
-		_, _ = w.Write([]byte("Form data received and printed"))
-	})
+			entryType := r.URL.Query().Get("type")
+			switch entryType {
+			case "":
+			case "dir", "file":
+				entries = filterType(entries, entryType == "dir")
+			default:
+				http.Error(w, "Invalid type; expected dir or file", http.StatusBadRequest)
+				return
+			}
 
-	mux.HandleFunc("DELETE /", func(w http.ResponseWriter, r *http.Request) {
-		relPath := r.URL.Path
-		// Safety checks: block root, empty, or suspicious paths
-		if relPath == "/" || relPath == "" || relPath == "*" || relPath == "/*" {
-			http.Error(w, "Refusing to delete root or wildcard path", http.StatusForbidden)
-			return
+			// Cursor pages are ordered by name alone so the cursor stays
+			// meaningful while entries come and go. A flattened subtree is
+			// always paged so one request can't list an entire tree.
+			query := r.URL.Query()
+			paged := query.Has("after") || query.Has("limit") || recursive
+			grouped := groupDirs && !paged
+			if !paged {
+				sortSpec := query.Get("sort")
+				if sortSpec == "" {
+					sortSpec = defaultSort
+				}
+				if err := sortListing(entries, sortSpec, grouped); err != nil {
+					writeError(w, err)
+					return
+				}
+			}
+
+			// Counts cover the whole directory, not just the page sent
+			total := len(entries)
+			counts := countEntries(entries)
+			w.Header().Set("X-Entry-Count", strconv.Itoa(counts.Total))
+			w.Header().Set("X-Dir-Count", strconv.Itoa(counts.Dirs))
+			w.Header().Set("X-File-Count", strconv.Itoa(counts.Files))
+			var truncated bool
+			var next string
+			if paged {
+				limit := 0
+				if v := query.Get("limit"); v != "" {
+					n, err := strconv.Atoi(v)
+					if err != nil || n <= 0 {
+						http.Error(w, "Invalid limit", http.StatusBadRequest)
+						return
+					}
+					limit = n
+				}
+				if recursive && limit == 0 {
+					limit = recursivePageSize
+				}
+				if listingLimit > 0 && (limit == 0 || limit > listingLimit) {
+					limit = listingLimit
+				}
+				entries, next = pageAfter(entries, query.Get("after"), limit)
+				truncated = next != ""
+			} else if truncated = listingLimit > 0 && total > listingLimit; truncated {
+				entries = entries[:listingLimit]
+			}
+
+			if r.URL.Query().Get("format") == "rss" {
+				writeRSS(w, r, basePath, entries)
+				return
+			}
+
+			// Long names can make a listing huge well within the entry limit
+			if maxListingBytes > 0 {
+				cost := func(entry listingEntry) int {
+					return len(htmlListingEntry(basePath, r.URL.Path, listingIcons, entry))
+				}
+				if wantsJSON(r) {
+					cost = jsonEntrySize
+				} else if wantsPlain(r) {
+					cost = plainEntrySize
+				}
+				var cut bool
+				if entries, cut = fitListingBytes(entries, maxListingBytes, cost); cut {
+					truncated = true
+					w.Header().Set("X-Listing-Truncated", "true")
+					if paged {
+						next = entries[len(entries)-1].Name
+					}
+				}
+			}
+			if next != "" {
+				w.Header().Set("X-Next-Cursor", next)
+			}
+
+			// The representation is negotiated from these headers
+			w.Header().Add("Vary", "Accept, User-Agent")
+
+			if wantsJSON(r) {
+				w.Header().Set("Content-Type", "application/json")
+				_ = json.NewEncoder(w).Encode(listing{Path: r.URL.Path, Entries: entries, Counts: counts, Truncated: truncated, NextCursor: next, Partial: partial})
+				return
+			}
+
+			if wantsPlain(r) {
+				w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+				writePlainListing(w, entries)
+				return
+			}
+
+			mobile := mobileListing && isMobile(r)
+			w.Header().Set("Content-Type", "text/html; charset=utf-8")
+			writeHTMLListing(w, htmlListing{
+				Title:      basePath + r.URL.Path,
+				BasePath:   basePath,
+				URLPath:    r.URL.Path,
+				Entries:    entries,
+				Grouped:    grouped,
+				Truncated:  truncated,
+				Total:      total,
+				NextCursor: next,
+				Type:       entryType,
+				Recursive:  recursive,
+				Partial:    partial,
+				Mobile:     mobile,
+				Icons:      listingIcons,
+			})
+		} else if q := r.URL.Query(); q.Has("head") || q.Has("tail") {
+			servePreview(w, r, f, fileInfo)
+		} else if r.URL.Query().Get("stat") == "1" {
+			sum, _ := sidecarChecksum(path)
+			w.Header().Set("Content-Type", "application/json")
+			_ = json.NewEncoder(w).Encode(fileStat{
+				Name:    fileInfo.Name(),
+				Size:    fileInfo.Size(),
+				ModTime: fileInfo.ModTime(),
+				ETag:    fileETag(fileInfo),
+				SHA256:  sum,
+			})
+		} else if algo := r.URL.Query().Get("checksum"); algo != "" {
+			sum, err := checksums.sum(path, algo, fileInfo)
+			if err != nil {
+				writeError(w, err)
+				return
+			}
+			if wantsJSON(r) {
+				w.Header().Set("Content-Type", "application/json")
+				_ = json.NewEncoder(w).Encode(map[string]string{"algorithm": algo, "digest": sum})
+				return
+			}
+			w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+			fmt.Fprintln(w, sum)
+		} else {
+			// Resuming clients send the ETag back in If-Range; a file edited
+			// since then gets a new one, so they restart instead of splicing
+			// old and new bytes
+			w.Header().Set("ETag", fileETag(fileInfo))
+			w.Header().Set("Accept-Ranges", "bytes")
+			if directive := cacheControl.match(r.URL.Path); directive != "" {
+				w.Header().Set("Cache-Control", directive)
+			}
+			if ctype := textCharset(mime.TypeByExtension(filepath.Ext(path)), defaultCharset); ctype != "" {
+				w.Header().Set("Content-Type", ctype)
+			}
+			for key, value := range manifests.headers(path) {
+				w.Header().Set(key, value)
+			}
+			if r.URL.Query().Get("download") == "1" {
+				w.Header().Set("Content-Disposition", contentDisposition("attachment", fileInfo.Name()))
+			}
+			// Serving the already open file keeps the bytes in step with the
+			// ETag even if the path is replaced meanwhile
+			var content io.ReadSeeker = f
+			fill := r.Method == http.MethodGet && r.Header.Get("Range") == ""
+			if cached := reads.open(path, f, fileInfo, fill); cached != nil {
+				defer cached.Close()
+				content = cached
+			}
+			readDone := timing.track("read")
+			stats.countDownload(w, func(w http.ResponseWriter) {
+				serveContent(w, r, fileInfo.Name(), fileInfo.ModTime(), content)
+			})
+			readDone()
+		}
+	})
+
+	// storeFile writes src to relPath beneath the request's root, creating
+	// parent directories as needed. size is the expected length, or -1 when
+	// unknown, and is checked against the disk usage quota up front. It
+	// returns the path actually stored, which differs from relPath when
+	// -on-conflict rename picked a free name.
+	storeFile := func(r *http.Request, relPath string, src io.Reader, size int64) (string, error) {
+		reserved := max(size, 0)
+		if err := usage.reserve(reserved); err != nil {
+			return "", err
+		}
+		defer usage.release(reserved)
+		counted := &countingReader{r: src}
+		stored := relPath
+		var diskPath string
+		var err error
+		if cas != nil {
+			// Logical names in the store are never renamed
+			if _, err := uploadResolverFor(r)(relPath); err != nil {
+				return "", err
+			}
+			key := casKey(path.Join(homeName(r, userHomes), relPath))
+			if err = cas.save(counted, key); err == nil {
+				entry, _ := cas.lookup(key)
+				diskPath = cas.blobPath(entry.SHA256)
+			}
+		} else {
+			filePath, resolveErr := uploadResolverFor(r)(relPath)
+			if resolveErr != nil {
+				return "", resolveErr
+			}
+			if err := os.MkdirAll(filepath.Dir(filePath), 0755); err != nil {
+				log.Printf("Error creating directory: %v\n", err)
+				return "", withDetail(&statusError{http.StatusInternalServerError, "Unable to create directory"}, err)
+			}
+			var savedPath string
+			savedPath, err = saveUpload(counted, filePath, tempDir, onConflict == "rename")
+			stored = path.Join(path.Dir(relPath), filepath.Base(savedPath))
+			diskPath = savedPath
+		}
+		if err != nil {
+			return "", err
+		}
+		// Blobs are shared between names, so they keep their own times
+		if cas == nil {
+			setUploadMtime(r, diskPath)
+		}
+		usage.add(counted.n)
+		stats.observeUpload(counted.n)
+		notifier.notify(path.Join("/", homeName(r, userHomes), stored), diskPath)
+		return stored, nil
+	}
+
+	// rawUpload stores the request body as a single file at X-Target-Path (or
+	// the request path), skipping multipart framing altogether
+	rawUpload := func(w http.ResponseWriter, r *http.Request) {
+		target := r.Header.Get("X-Target-Path")
+		if target == "" {
+			target = r.URL.Path
 		}
-		// Prevent attempts to delete outside the prefix
-		path := filepath.Join(dirPrefix, relPath)
-		absPrefix, _ := filepath.Abs(dirPrefix)
-		absPath, _ := filepath.Abs(path)
-		if absPrefix == absPath {
-			http.Error(w, "Refusing to delete root directory", http.StatusForbidden)
+		relPath := path.Join("/", target)
+		if relPath == "/" {
+			http.Error(w, "Target path not provided", http.StatusBadRequest)
 			return
 		}
-		if len(relPath) == 0 || relPath == "/" || relPath == "*" || relPath == "/*" {
-			http.Error(w, "Invalid delete path", http.StatusForbidden)
+
+		stored, err := storeFile(r, relPath, r.Body, r.ContentLength)
+		if err != nil {
+			audit.record(r, "upload", relPath, err)
+			writeError(w, err)
+			return
+		}
+		// -on-conflict rename may have stored it under another name
+		audit.record(r, "upload", stored, nil)
+		w.Header().Set("X-Stored-Path", stored)
+		w.WriteHeader(http.StatusCreated)
+		_, _ = w.Write([]byte("Created"))
+	}
+
+	// fileLocks serializes writers that work on an existing or partial file
+	fileLocks := newPathLocks()
+
+	// editUpload replaces an existing file with the PUT body, but only while
+	// its ETag still matches If-Match. Holding the path's lock across the
+	// check and the swap means two editors starting from the same version
+	// can't both win.
+	editUpload := func(w http.ResponseWriter, r *http.Request) {
+		if cas != nil {
+			http.Error(w, "Conditional uploads are not supported with -cas", http.StatusBadRequest)
 			return
 		}
-		info, err := os.Stat(path)
+		filePath, err := uploadResolverFor(r)(r.URL.Path)
 		if err != nil {
-			http.Error(w, "File or directory not found", http.StatusNotFound)
+			writeError(w, err)
 			return
 		}
-		// Remove file or directory
-		var removeErr error
-		if info.IsDir() {
-			removeErr = os.RemoveAll(path)
-		} else {
-			removeErr = os.Remove(path)
+		unlock := fileLocks.lock(filePath)
+		defer unlock()
+
+		info, err := os.Stat(filePath)
+		if err != nil || info.IsDir() || !etagMatches(r.Header.Get("If-Match"), fileETag(info)) {
+			err = &statusError{http.StatusPreconditionFailed, "File has changed"}
+		} else if err = usage.reserve(max(r.ContentLength, 0)); err == nil {
+			err = replaceUpload(r.Body, filePath)
+			usage.release(max(r.ContentLength, 0))
 		}
-		if removeErr != nil {
-			log.Printf("Error deleting: %v\n", removeErr)
-			http.Error(w, "Unable to delete", http.StatusInternalServerError)
+		audit.record(r, "edit", r.URL.Path, err)
+		usage.invalidate()
+		if err != nil {
+			writeError(w, err)
 			return
 		}
+		setUploadMtime(r, filePath)
+		if info, err := os.Stat(filePath); err == nil {
+			w.Header().Set("ETag", fileETag(info))
+			stats.observeUpload(info.Size())
+		}
+		notifier.notify(path.Join("/", homeName(r, userHomes), r.URL.Path), filePath)
 		w.WriteHeader(http.StatusOK)
-		_, _ = w.Write([]byte("Deleted"))
-	})
+		_, _ = w.Write([]byte("Updated"))
+	}
 
-	srv := http.Server{
-		Addr:    ":8080",
-		Handler: mux,
+	// Partial uploads are kept apart from the served tree, so nothing but
+	// resumableUpload ever creates a file there
+	partsDir := filepath.Join(dirPrefix, partsDirName)
+
+	// resumableUpload writes one Content-Range chunk of a PUT into a .part
+	// file in partsDir. The .part file always holds the contiguous
+	// bytes received so far, so a chunk may overlap what is there but not
+	// start past its end; the upload is put in place once it covers the
+	// whole length.
+	resumableUpload := func(w http.ResponseWriter, r *http.Request) {
+		if cas != nil {
+			http.Error(w, "Resumable uploads are not supported with -cas", http.StatusBadRequest)
+			return
+		}
+		start, end, total, err := parseContentRange(r.Header.Get("Content-Range"))
+		if err != nil || (r.ContentLength >= 0 && r.ContentLength != end-start+1) {
+			http.Error(w, "Invalid Content-Range", http.StatusBadRequest)
+			return
+		}
+		relPath := path.Join("/", r.URL.Path)
+		if relPath == "/" {
+			http.Error(w, "Target path not provided", http.StatusBadRequest)
+			return
+		}
+		filePath, err := uploadResolverFor(r)(relPath)
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+		partPath := partFile(partsDir, filePath)
+
+		unlock := fileLocks.lock(filePath)
+		defer unlock()
+		unlockPart := fileLocks.lock(partPath)
+		defer unlockPart()
+		if _, err := os.Stat(filePath); err == nil {
+			http.Error(w, "File already exists", http.StatusConflict)
+			return
+		}
+		var received int64
+		if info, err := os.Stat(partPath); err == nil {
+			received = info.Size()
+		}
+		if received > total {
+			http.Error(w, "Content-Range total does not match the upload in progress", http.StatusBadRequest)
+			return
+		}
+		if start > received {
+			w.Header().Set("X-Expected-Offset", strconv.FormatInt(received, 10))
+			w.Header().Set("Content-Range", fmt.Sprintf("bytes */%d", total))
+			http.Error(w, fmt.Sprintf("Chunk leaves a gap; expected offset %d", received), http.StatusRequestedRangeNotSatisfiable)
+			return
+		}
+
+		if err := usage.reserve(end - start + 1); err != nil {
+			writeError(w, err)
+			return
+		}
+		defer usage.release(end - start + 1)
+		for _, dir := range []string{filepath.Dir(filePath), partsDir} {
+			if err := os.MkdirAll(dir, 0755); err != nil {
+				writeError(w, withDetail(&statusError{http.StatusInternalServerError, "Unable to create directory"}, err))
+				return
+			}
+		}
+		n, err := writeChunk(partPath, r.Body, start, end-start+1)
+		usage.add(max(start+n-received, 0))
+		received = max(received, start+n)
+		if err != nil {
+			audit.record(r, "upload", relPath, err)
+			writeError(w, err)
+			return
+		}
+		if received < total {
+			w.Header().Set("X-Expected-Offset", strconv.FormatInt(received, 10))
+			w.WriteHeader(http.StatusAccepted)
+			_, _ = w.Write([]byte("Chunk received"))
+			return
+		}
+
+		err = os.Chmod(partPath, 0444)
+		if err == nil {
+			err = placeUpload(partPath, filePath)
+		}
+		audit.record(r, "upload", relPath, err)
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+		os.Remove(partPath)
+		setUploadMtime(r, filePath)
+		stats.observeUpload(total)
+		notifier.notify(path.Join("/", homeName(r, userHomes), relPath), filePath)
+		log.Printf("File saved: %s\n", filePath)
+		w.WriteHeader(http.StatusCreated)
+		_, _ = w.Write([]byte("Created"))
 	}
 
-	quit := make(chan os.Signal, 1)
-	signal.Notify(quit, syscall.SIGINT, syscall.SIGTERM)
+	// abortUpload discards the .part file of a resumable upload, so the
+	// next chunk has to start again from offset 0.
+	abortUpload := func(w http.ResponseWriter, r *http.Request) {
+		relPath := path.Join("/", r.URL.Path)
+		filePath, err := resolverFor(r)(relPath)
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+		partPath := partFile(partsDir, filePath)
+		unlock := fileLocks.lock(filePath)
+		unlockPart := fileLocks.lock(partPath)
+		err = os.Remove(partPath)
+		unlockPart()
+		unlock()
+		if errors.Is(err, fs.ErrNotExist) {
+			http.Error(w, "No upload in progress", http.StatusNotFound)
+			return
+		}
+		audit.record(r, "abort", relPath, err)
+		usage.invalidate()
+		if err != nil {
+			writeError(w, withDetail(&statusError{http.StatusInternalServerError, "Unable to abort upload"}, err))
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+		_, _ = w.Write([]byte("Aborted"))
+	}
 
-	go func() {
-		<-quit
-		log.Println("Shutting down...")
-		if err := srv.Shutdown(context.Background()); err != nil {
-			log.Fatal(err)
+	if partTTL > 0 {
+		go func() {
+			ticker := time.NewTicker(min(partTTL, time.Hour))
+			defer ticker.Stop()
+			for {
+				select {
+				case <-stop:
+					return
+				case <-ticker.C:
+				}
+				if n := removeStaleParts(partsDir, partTTL, fileLocks); n > 0 {
+					usage.invalidate()
+					log.Printf("Removed %d abandoned partial uploads\n", n)
+				}
+			}
+		}()
+	}
+
+	// limitUpload applies -max-upload to the request body. A declared length
+	// over the limit is refused before anything is read, so clients sending
+	// Expect: 100-continue never transmit the body. Chunked bodies carry no
+	// Content-Length and are cut off while reading instead.
+	limitUpload := func(w http.ResponseWriter, r *http.Request) bool {
+		if maxUpload <= 0 {
+			return true
 		}
-	}()
+		if r.ContentLength > maxUpload {
+			http.Error(w, "Upload too large", http.StatusRequestEntityTooLarge)
+			return false
+		}
+		r.Body = http.MaxBytesReader(w, r.Body, maxUpload)
+		return true
+	}
 
-	log.Println("Starting server on :8080...")
-	if err := srv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
-		log.Fatal(err)
+	// validateUpload answers ?validate=1 by running an upload's checks
+	// against its declared length, from X-Upload-Length, and target without
+	// reading a body or writing anything. 204 means the upload would be
+	// accepted as things stand.
+	validateUpload := func(w http.ResponseWriter, r *http.Request) {
+		size := declaredLength(r)
+		if maxUpload > 0 && size > maxUpload {
+			http.Error(w, "Upload too large", http.StatusRequestEntityTooLarge)
+			return
+		}
+		// A multipart form names its files in the body, so a POST has to
+		// give its target in X-Target-Path
+		target := r.URL.Path
+		if r.Method == http.MethodPost {
+			target = r.Header.Get("X-Target-Path")
+		}
+		relPath := path.Join("/", target)
+		if relPath == "/" {
+			http.Error(w, "Target path not provided", http.StatusBadRequest)
+			return
+		}
+		filePath, err := uploadResolverFor(r)(relPath)
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+
+		info, statErr := os.Stat(filePath)
+		switch {
+		case cas != nil:
+			if _, taken := cas.lookup(casKey(path.Join(homeName(r, userHomes), relPath))); taken {
+				err = &statusError{http.StatusConflict, "File already exists"}
+			}
+		case r.Method == http.MethodPut && r.Header.Get("If-Match") != "":
+			if statErr != nil || info.IsDir() || !etagMatches(r.Header.Get("If-Match"), fileETag(info)) {
+				err = &statusError{http.StatusPreconditionFailed, "File has changed"}
+			}
+		case statErr == nil && onConflict != "rename":
+			err = &statusError{http.StatusConflict, "File already exists"}
+		}
+		// Only a check: the upload itself reserves when it arrives
+		if err == nil {
+			if err = usage.reserve(max(size, 0)); err == nil {
+				usage.release(max(size, 0))
+			}
+		}
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}
+
+	mux.HandleFunc("PUT /", func(w http.ResponseWriter, r *http.Request) {
+		if noUpload {
+			methodNotAllowed(w, allow)
+			return
+		}
+		if r.URL.Query().Get("validate") == "1" {
+			validateUpload(w, r)
+			return
+		}
+		if !limitUpload(w, r) {
+			return
+		}
+		defer progress.track(r, homeName(r, userHomes))()
+		if r.Header.Get("Content-Range") != "" {
+			resumableUpload(w, r)
+			return
+		}
+		if r.Header.Get("If-Match") != "" {
+			editUpload(w, r)
+			return
+		}
+		rawUpload(w, r)
+	})
+
+	mux.HandleFunc("POST /", func(w http.ResponseWriter, r *http.Request) {
+		if noUpload {
+			methodNotAllowed(w, allow)
+			return
+		}
+		if r.URL.Query().Get("validate") == "1" {
+			validateUpload(w, r)
+			return
+		}
+		if !limitUpload(w, r) {
+			return
+		}
+		defer progress.track(r, homeName(r, userHomes))()
+
+		if r.Header.Get("X-Target-Path") != "" {
+			rawUpload(w, r)
+			return
+		}
+
+		action := r.URL.Query().Get("action")
+		if noDelete && (action == "batch-delete" || action == "batch-move") {
+			methodNotAllowed(w, allow)
+			return
+		}
+		switch action {
+		case "":
+		case "batch-delete":
+			var paths []string
+			if err := json.NewDecoder(r.Body).Decode(&paths); err != nil {
+				http.Error(w, "Expected a JSON array of paths", http.StatusBadRequest)
+				return
+			}
+			resolve := resolverFor(r)
+			results := make([]batchResult, 0, len(paths))
+			for _, p := range paths {
+				result := batchResult{Path: p, OK: true}
+				err := removePath(resolve, p, "")
+				audit.record(r, "delete", p, err)
+				if err != nil {
+					result.OK = false
+					result.Error = err.Error()
+				}
+				results = append(results, result)
+			}
+			usage.invalidate()
+			w.Header().Set("Content-Type", "application/json")
+			_ = json.NewEncoder(w).Encode(results)
+			return
+		case "batch-move":
+			var moves []batchMove
+			if err := json.NewDecoder(r.Body).Decode(&moves); err != nil {
+				http.Error(w, "Expected a JSON array of {from, to} pairs", http.StatusBadRequest)
+				return
+			}
+			// A move writes its target and takes away its source, so both
+			// ends are held to -upload-dir
+			resolve := uploadResolverFor(r)
+			results := make([]batchResult, 0, len(moves))
+			for _, m := range moves {
+				result := batchResult{Path: m.From, To: m.To, OK: true}
+				err := movePath(resolve, m.From, m.To, m.Overwrite)
+				audit.recordMove(r, m.From, m.To, err)
+				if err != nil {
+					result.OK = false
+					result.Error = err.Error()
+				}
+				results = append(results, result)
+			}
+			w.Header().Set("Content-Type", "application/json")
+			_ = json.NewEncoder(w).Encode(results)
+			return
+		case "fetch":
+			if len(fetch.hosts) == 0 {
+				http.Error(w, "Server-side fetch is disabled", http.StatusForbidden)
+				return
+			}
+			var req struct {
+				URL string `json:"url"`
+			}
+			if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.URL == "" {
+				http.Error(w, `Expected {"url": "..."}`, http.StatusBadRequest)
+				return
+			}
+			relPath := path.Join("/", r.URL.Path)
+			if relPath == "/" {
+				http.Error(w, "Target path not provided", http.StatusBadRequest)
+				return
+			}
+
+			body, err := fetch.open(r.Context(), req.URL)
+			if err != nil {
+				audit.record(r, "fetch", relPath, err)
+				writeError(w, err)
+				return
+			}
+			src := &countingReader{r: body}
+			stored, err := storeFile(r, relPath, src, -1)
+			body.Close()
+			if err != nil {
+				audit.record(r, "fetch", relPath, err)
+				writeError(w, err)
+				return
+			}
+			audit.record(r, "fetch", stored, nil)
+			log.Printf("Fetched %s into %s (%d bytes)\n", req.URL, stored, src.n)
+			w.Header().Set("Content-Type", "application/json")
+			w.Header().Set("X-Stored-Path", stored)
+			w.WriteHeader(http.StatusCreated)
+			_ = json.NewEncoder(w).Encode(map[string]any{"path": stored, "size": src.n})
+			return
+		default:
+			http.Error(w, "Unknown action", http.StatusBadRequest)
+			return
+		}
+
+		err := r.ParseMultipartForm(multipartMem)
+		if err != nil {
+			var maxBytesErr *http.MaxBytesError
+			if errors.As(err, &maxBytesErr) {
+				http.Error(w, "Upload too large", http.StatusRequestEntityTooLarge)
+				return
+			}
+			http.Error(w, "Unable to parse form", http.StatusBadRequest)
+			return
+		}
+		// Parts over -multipart-mem were spilled to temp files
+		defer func() { _ = r.MultipartForm.RemoveAll() }()
+
+		// Check for "name" key and create directory if it exists
+		var dirName, dirPath string
+		var created bool
+		if names, ok := r.MultipartForm.Value["name"]; ok && len(names) > 0 {
+			dirName = names[0]
+			// Users must not be able to reach into each other's homes
+			var err error
+			dirPath, err = uploadResolverFor(r)(dirName)
+			var se *statusError
+			if errors.As(err, &se) {
+				writeError(w, err)
+				return
+			} else if err != nil {
+				http.Error(w, "Invalid directory name", http.StatusBadRequest)
+				return
+			}
+			// Blobs live in the store, so there is no real directory to create
+			if cas == nil {
+				err := os.Mkdir(dirPath, 0755)
+				if err != nil && !os.IsExist(err) {
+					audit.record(r, "mkdir", path.Join("/", dirName), err)
+					writeError(w, withDetail(&statusError{http.StatusInternalServerError, "Unable to create directory"}, err))
+					return
+				}
+				if created = err == nil; created {
+					audit.record(r, "mkdir", path.Join("/", dirName), nil)
+				}
+				log.Printf("Created directory: %s\n", dirName)
+			}
+		} else {
+			http.Error(w, "Directory name not provided", http.StatusBadRequest)
+			return
+		}
+
+		// Save uploaded files to the created directory
+		var storedAny bool
+		// Don't leave behind an empty directory this request made for files
+		// that never arrived
+		dropEmptyDir := func() {
+			if created && !storedAny {
+				if err := os.Remove(dirPath); err == nil {
+					log.Printf("Removed directory: %s\n", dirName)
+				}
+			}
+		}
+		for key, files := range r.MultipartForm.File {
+			for _, file := range files {
+				log.Printf("File: %s, Name: %s, Size: %d bytes\n", key, file.Filename, file.Size)
+
+				// Open the uploaded file
+				src, err := file.Open()
+				if err != nil {
+					log.Printf("Error opening uploaded file: %v\n", err)
+					continue
+				}
+
+				relPath := path.Join("/", dirName, file.Filename)
+				stored, err := storeFile(r, relPath, src, file.Size)
+				src.Close()
+				if err != nil {
+					audit.record(r, "upload", relPath, err)
+					dropEmptyDir()
+					writeError(w, err)
+					return
+				}
+				audit.record(r, "upload", stored, nil)
+				storedAny = true
+				w.Header().Add("X-Stored-Path", stored)
+			}
+		}
+		dropEmptyDir()
+
+		w.WriteHeader(http.StatusOK)
+		_, _ = w.Write([]byte("Form data received and printed"))
+	})
+
+	mux.HandleFunc("DELETE /", func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("action") == "abort" {
+			if noUpload {
+				methodNotAllowed(w, allow)
+				return
+			}
+			abortUpload(w, r)
+			return
+		}
+		if noDelete {
+			methodNotAllowed(w, allow)
+			return
+		}
+		if jobs != nil && preferAsync(r) {
+			target, info, err := deleteTarget(resolverFor(r), r.URL.Path, r.Header.Get("If-Match"))
+			if err == nil && info.IsDir() {
+				// The request outlives its handler only as far as auditing goes
+				req := r.Clone(context.Background())
+				job := jobs.start(homeName(r, userHomes), r.URL.Path, target, func(err error) {
+					audit.record(req, "delete", req.URL.Path, err)
+					usage.invalidate()
+				})
+				w.Header().Set("Preference-Applied", "respond-async")
+				w.Header().Set("Location", path.Join(basePath, "/jobs", job.ID))
+				w.Header().Set("Content-Type", "application/json")
+				w.WriteHeader(http.StatusAccepted)
+				_ = json.NewEncoder(w).Encode(job.status())
+				return
+			} else if err != nil {
+				audit.record(r, "delete", r.URL.Path, err)
+				writeError(w, err)
+				return
+			}
+			// A single file goes quickly, so it is deleted right away
+		}
+		err := removePath(resolverFor(r), r.URL.Path, r.Header.Get("If-Match"))
+		audit.record(r, "delete", r.URL.Path, err)
+		usage.invalidate()
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+		_, _ = w.Write([]byte("Deleted"))
+	})
+
+	addrs := splitList(listenAddrs)
+	if len(addrs) == 0 {
+		log.Fatal("No listen address provided")
+	}
+
+	// Middleware listed innermost first
+	var handler http.Handler = mux
+	handler = withBasicAuth(handler, users)
+	handler = withMaintenance(handler, &maintenance, maintenanceMessage, maintenanceRetry)
+	// Outside auth so a refused network learns nothing from the challenge
+	handler = withIPAllowList(handler, readAllow, writeAllow)
+	if fallbackPage != "" {
+		page, err := os.ReadFile(fallbackPage)
+		if err != nil {
+			log.Fatalf("Unable to read fallback page: %v", err)
+		}
+		if backendCheck <= 0 {
+			log.Fatal("-backend-check-interval must be positive")
+		}
+		var backendDown atomic.Bool
+		go monitorPrefix(dirPrefix, backendCheck, &backendDown, stop)
+		handler = withFallback(handler, &backendDown, page, backendCheck)
+	}
+	handler = withBasePath(handler, basePath)
+	if gzipOn {
+		handler = withGzip(handler, gzipMinSize)
+	}
+	if uploadQuota > 0 || downloadQuota > 0 {
+		// Outside gzip so downloads are charged what went over the wire
+		handler = withByteQuotas(handler, newByteQuota(uploadQuota, quotaWindow, stop), newByteQuota(downloadQuota, quotaWindow, stop))
+	}
+	handler = withHeaders(handler, extraHeaders.header)
+	handler = withoutTrace(handler, allow)
+	if serverTimingOn {
+		// Outside gzip so compression is part of what gets timed
+		handler = withServerTiming(handler)
+	}
+	if slowThreshold > 0 {
+		handler = withSlowLog(handler, slowThreshold)
+	}
+	if accessLogJSON {
+		handler = withJSONAccessLog(handler, os.Stdout)
+	}
+	if methodOverride {
+		// Outermost so every check, and the logs, see the resolved method
+		handler = withMethodOverride(handler)
+	}
+
+	return &app{
+		handler:     handler,
+		addrs:       addrs,
+		dirPrefix:   dirPrefix,
+		keepAlive:   tcpKeepAlive,
+		reusePort:   reusePort,
+		ready:       &ready,
+		maintenance: &maintenance,
+		audit:       audit,
+		stop:        stop,
+	}
+}
+
+// listenAll binds every address, closing any that succeeded if one fails.
+// Accepted connections use keepAlive as their probe period, with 0
+// turning keep-alive probes off. With reusePort the sockets get
+// SO_REUSEPORT; where the kernel refuses it the listener is bound without.
+func listenAll(addrs []string, keepAlive time.Duration, reusePort bool) ([]net.Listener, error) {
+	lc := net.ListenConfig{KeepAlive: keepAlive}
+	if keepAlive == 0 {
+		lc.KeepAlive = -1
+	}
+	if opt, ok := soReusePort(); reusePort && !ok {
+		log.Printf("Warning: SO_REUSEPORT is not supported on %s, ignoring -reuseport\n", runtime.GOOS)
+	} else if reusePort {
+		lc.Control = func(network, address string, c syscall.RawConn) error {
+			var sockErr error
+			err := c.Control(func(fd uintptr) {
+				sockErr = setReusePort(fd, opt)
+			})
+			if err == nil && sockErr != nil {
+				log.Printf("Warning: SO_REUSEPORT unavailable on %s: %v\n", address, sockErr)
+			}
+			return err
+		}
+	}
+	var listeners []net.Listener
+	var errs []error
+	for _, addr := range addrs {
+		ln, err := lc.Listen(context.Background(), "tcp", addr)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("listen on %s: %w", addr, err))
+			continue
+		}
+		listeners = append(listeners, ln)
+	}
+	if len(errs) > 0 {
+		for _, ln := range listeners {
+			ln.Close()
+		}
+		return nil, errors.Join(errs...)
+	}
+	return listeners, nil
+}
+
+// serveZip sends the directory at dir as a ZIP archive. Small trees are built
+// into a temp file first so the response supports Range requests; larger
+// ones are streamed straight to the client.
+func serveZip(w http.ResponseWriter, r *http.Request, dir string, prebuildMax int64, level, workers int, walker treeWalker) {
+	size, modTime, limited, err := treeStats(dir, walker)
+	if err != nil {
+		log.Printf("Error scanning directory for archive: %v\n", err)
+		http.Error(w, "Error reading directory", http.StatusInternalServerError)
+		return
+	}
+	// The archive walk stops at the same depth as the scan
+	w.Header().Set("X-Depth-Limited", strconv.FormatBool(limited))
+
+	name := filepath.Base(dir) + ".zip"
+	w.Header().Set("Content-Disposition", contentDisposition("attachment", name))
+
+	if prebuildMax <= 0 || size > prebuildMax {
+		// A streamed archive can't be seeked, so any Range is answered with
+		// the whole archive rather than a partial response
+		if r.Header.Get("Range") != "" {
+			log.Printf("Ignoring Range request for streamed archive %s\n", name)
+		}
+		// The size isn't known until the stream ends, so the response goes
+		// out chunked
+		w.Header().Set("Content-Type", "application/zip")
+		w.Header().Set("Accept-Ranges", "none")
+		w.Header().Del("Content-Length")
+		w.WriteHeader(http.StatusOK)
+		if r.Method == http.MethodHead {
+			return
+		}
+		if err := writeZip(w, dir, level, workers, walker); err != nil {
+			// Headers are already sent; all we can do is cut the stream short
+			log.Printf("Error streaming archive: %v\n", err)
+		}
+		return
+	}
+
+	tmp, err := os.CreateTemp("", "gopi-*.zip")
+	if err != nil {
+		log.Printf("Error creating archive temp file: %v\n", err)
+		http.Error(w, "Error building archive", http.StatusInternalServerError)
+		return
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	if err := writeZip(tmp, dir, level, workers, walker); err != nil {
+		log.Printf("Error building archive: %v\n", err)
+		http.Error(w, "Error building archive", http.StatusInternalServerError)
+		return
+	}
+	// ServeContent takes the exact Content-Length from the finished archive,
+	// giving clients an accurate progress bar. HEAD gets the same headers,
+	// which is why the archive is built even then.
+	serveContent(w, r, name, modTime, tmp)
+}
+
+// serveContent is http.ServeContent, except that a Range none of whose
+// ranges overlap the content is refused with 416 and the content's size.
+// ServeContent answers some of those, like a suffix of zero bytes or any
+// range of an empty file, with a malformed 206 instead. Conditional
+// requests are left to ServeContent, since their preconditions come first.
+func serveContent(w http.ResponseWriter, r *http.Request, name string, modTime time.Time, content io.ReadSeeker) {
+	if ranges := r.Header.Get("Range"); ranges != "" && !hasPreconditions(r) {
+		size, err := content.Seek(0, io.SeekEnd)
+		if err == nil {
+			_, err = content.Seek(0, io.SeekStart)
+		}
+		if err == nil && !rangeSatisfiable(ranges, size) {
+			w.Header().Set("Content-Range", fmt.Sprintf("bytes */%d", size))
+			http.Error(w, "Requested range not satisfiable", http.StatusRequestedRangeNotSatisfiable)
+			return
+		}
+	}
+	http.ServeContent(w, r, name, modTime, content)
+}
+
+// servePreview answers ?head=N and ?tail=N on text files with the first or
+// last N lines, or bytes with unit=bytes. Only the needed part of the file
+// is read: tails are found by scanning backwards from the end.
+// X-Preview-Truncated tells whether anything was left out.
+func servePreview(w http.ResponseWriter, r *http.Request, f *os.File, info os.FileInfo) {
+	q := r.URL.Query()
+	fromEnd := q.Has("tail")
+	n, err := strconv.ParseInt(q.Get("head"), 10, 64)
+	if fromEnd {
+		n, err = strconv.ParseInt(q.Get("tail"), 10, 64)
+	}
+	if err != nil || n < 0 || (q.Has("head") && fromEnd) {
+		http.Error(w, "Expected one of head=N or tail=N", http.StatusBadRequest)
+		return
+	}
+	bytesUnit := q.Get("unit") == "bytes"
+	if !bytesUnit && q.Has("unit") && q.Get("unit") != "lines" {
+		http.Error(w, "Invalid unit", http.StatusBadRequest)
+		return
+	}
+
+	// Either the extension or the content has to say text
+	sniff := make([]byte, 512)
+	sn, _ := f.ReadAt(sniff, 0)
+	if !strings.HasPrefix(mime.TypeByExtension(filepath.Ext(info.Name())), "text/") &&
+		!strings.HasPrefix(http.DetectContentType(sniff[:sn]), "text/") {
+		http.Error(w, "Previews are only available for text files", http.StatusUnsupportedMediaType)
+		return
+	}
+
+	start, end := int64(0), info.Size()
+	switch {
+	case fromEnd && bytesUnit:
+		start = max(end-n, 0)
+	case fromEnd:
+		start, err = tailOffset(f, end, n)
+	case bytesUnit:
+		end = min(n, end)
+	default:
+		end, err = headOffset(f, n)
+	}
+	if err != nil {
+		log.Printf("Error reading preview: %v\n", err)
+		http.Error(w, "Error reading file", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Header().Set("Content-Length", strconv.FormatInt(end-start, 10))
+	w.Header().Set("X-Preview-Truncated", strconv.FormatBool(start > 0 || end < info.Size()))
+	if r.Method == http.MethodHead {
+		return
+	}
+	_, _ = io.Copy(w, io.NewSectionReader(f, start, end-start))
+}
+
+// headOffset returns the offset just past the first n lines of f.
+func headOffset(f io.ReaderAt, n int64) (int64, error) {
+	br := bufio.NewReader(io.NewSectionReader(f, 0, math.MaxInt64))
+	var offset int64
+	for ; n > 0; n-- {
+		line, err := br.ReadSlice('\n')
+		offset += int64(len(line))
+		if errors.Is(err, bufio.ErrBufferFull) {
+			n++
+			continue
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return 0, err
+		}
+	}
+	return offset, nil
+}
+
+// tailOffset returns the offset where the last n lines of f begin, reading
+// backwards from the end a block at a time. A final newline ends the last
+// line rather than starting another.
+func tailOffset(f io.ReaderAt, size, n int64) (int64, error) {
+	if n == 0 {
+		return size, nil
+	}
+	buf := make([]byte, 64<<10)
+	var count int64
+	for end := size; end > 0; {
+		start := max(end-int64(len(buf)), 0)
+		chunk := buf[:end-start]
+		if _, err := f.ReadAt(chunk, start); err != nil && err != io.EOF {
+			return 0, err
+		}
+		for i := len(chunk) - 1; i >= 0; i-- {
+			if chunk[i] != '\n' || start+int64(i) == size-1 {
+				continue
+			}
+			if count++; count == n {
+				return start + int64(i) + 1, nil
+			}
+		}
+		end = start
+	}
+	return 0, nil
+}
+
+// hasPreconditions reports whether r carries any conditional header.
+func hasPreconditions(r *http.Request) bool {
+	for _, key := range []string{"If-Match", "If-None-Match", "If-Modified-Since", "If-Unmodified-Since", "If-Range"} {
+		if r.Header.Get(key) != "" {
+			return true
+		}
+	}
+	return false
+}
+
+// rangeSatisfiable reports whether a bytes Range header selects anything
+// from content of the given size. Headers it can't parse count as
+// satisfiable, leaving ServeContent to decide what to do with them.
+func rangeSatisfiable(header string, size int64) bool {
+	specs, ok := strings.CutPrefix(header, "bytes=")
+	if !ok {
+		return true
+	}
+	for _, spec := range strings.Split(specs, ",") {
+		first, last, ok := strings.Cut(strings.TrimSpace(spec), "-")
+		if !ok {
+			return true
+		}
+		if first == "" {
+			// A suffix takes its last N bytes
+			n, err := strconv.ParseInt(last, 10, 64)
+			if err != nil || (n > 0 && size > 0) {
+				return true
+			}
+			continue
+		}
+		start, err := strconv.ParseInt(first, 10, 64)
+		if err != nil || start < size {
+			return true
+		}
+	}
+	return false
+}
+
+// treeWalker walks directory trees for recursive operations, leaving out
+// hidden paths and not descending below maxDepth levels (0 for no limit).
+type treeWalker struct {
+	hidden   func(string) bool
+	maxDepth int
+}
+
+// walk calls fn for each visible entry under root like filepath.WalkDir.
+// It reports whether some directory had to be left unexplored because of
+// the depth limit.
+func (t treeWalker) walk(root string, fn fs.WalkDirFunc) (bool, error) {
+	limited := false
+	err := filepath.WalkDir(root, func(p string, d fs.DirEntry, err error) error {
+		if err == nil && t.hidden != nil && t.hidden(p) {
+			if d.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if err := fn(p, d, err); err != nil {
+			return err
+		}
+		if t.maxDepth <= 0 || d == nil || !d.IsDir() {
+			return nil
+		}
+		rel, _ := filepath.Rel(root, p)
+		if rel == "." || strings.Count(rel, string(filepath.Separator))+1 < t.maxDepth {
+			return nil
+		}
+		// Only a directory with something in it is actually cut short
+		if dir, err := os.Open(p); err == nil {
+			if names, _ := dir.Readdirnames(1); len(names) > 0 {
+				limited = true
+			}
+			dir.Close()
+		}
+		return filepath.SkipDir
+	})
+	return limited, err
+}
+
+// treeStats returns the total size of the regular files under root and the
+// latest modification time in the tree, and whether the walk was depth
+// limited.
+func treeStats(root string, walker treeWalker) (int64, time.Time, bool, error) {
+	var size int64
+	var modTime time.Time
+	limited, err := walker.walk(root, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		if info.ModTime().After(modTime) {
+			modTime = info.ModTime()
+		}
+		if info.Mode().IsRegular() {
+			size += info.Size()
+		}
+		return nil
+	})
+	return size, modTime, limited, err
+}
+
+// manifestEntry describes one file in a ?manifest=1 response.
+type manifestEntry struct {
+	Path    string    `json:"path"`
+	Size    int64     `json:"size"`
+	ModTime time.Time `json:"mod_time"`
+	SHA256  string    `json:"sha256"`
+}
+
+// writeManifest streams a JSON array describing every regular file under
+// root modified after since, one element at a time. Symlinks are not
+// followed and subtrees that can't be read are skipped. It reports whether
+// the walk was depth limited.
+func writeManifest(w io.Writer, root string, since time.Time, walker treeWalker, checksums *checksumCache) bool {
+	_, _ = io.WriteString(w, "[")
+	enc := json.NewEncoder(w)
+	first := true
+	limited, _ := walker.walk(root, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if d != nil && d.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !d.Type().IsRegular() {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil || !info.ModTime().After(since) {
+			return nil
+		}
+		sum, err := checksums.sum(p, "sha256", info)
+		if err != nil {
+			return nil
+		}
+		rel, _ := filepath.Rel(root, p)
+		if !first {
+			_, _ = io.WriteString(w, ",")
+		}
+		first = false
+		return enc.Encode(manifestEntry{Path: filepath.ToSlash(rel), Size: info.Size(), ModTime: info.ModTime(), SHA256: sum})
+	})
+	_, _ = io.WriteString(w, "]\n")
+	return limited
+}
+
+// syncHeader opens every sync listing, naming its columns.
+const syncHeader = "# gopi-sync 1 path size mtime-ns crc32c\n"
+
+// syncPathEscaper keeps paths on a single tab-separated line.
+var syncPathEscaper = strings.NewReplacer("%", "%25", "\t", "%09", "\n", "%0A", "\r", "%0D")
+
+// writeSyncList streams one tab-separated line per regular file under root
+// modified after since, in lexical path order so two listings can be
+// diffed directly. It reports whether the walk was depth limited.
+func writeSyncList(w io.Writer, root string, since time.Time, walker treeWalker) bool {
+	_, _ = io.WriteString(w, syncHeader)
+	bw := bufio.NewWriter(w)
+	defer bw.Flush()
+	limited, _ := walker.walk(root, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if d != nil && d.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !d.Type().IsRegular() {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil || !info.ModTime().After(since) {
+			return nil
+		}
+		sum, err := quickHash(p, info.Size())
+		if err != nil {
+			return nil
+		}
+		rel, _ := filepath.Rel(root, p)
+		_, err = fmt.Fprintf(bw, "%s\t%d\t%d\t%08x\n", syncPathEscaper.Replace(filepath.ToSlash(rel)), info.Size(), info.ModTime().UnixNano(), sum)
+		return err
+	})
+	return limited
+}
+
+var castagnoli = crc32.MakeTable(crc32.Castagnoli)
+
+// quickHashSpan is how much of each end of a file quickHash reads.
+const quickHashSpan = 64 << 10
+
+// quickHash fingerprints a file of the given size from its first and last
+// quickHashSpan bytes. It is cheap enough to compute for a whole tree on
+// every request, and catches the changes size and mtime alone would miss
+// without proving two files identical.
+func quickHash(p string, size int64) (uint32, error) {
+	f, err := os.Open(p)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	h := crc32.New(castagnoli)
+	if _, err := io.CopyN(h, f, min(size, quickHashSpan)); err != nil {
+		return 0, err
+	}
+	if tail := size - quickHashSpan; tail > 0 {
+		if _, err := f.Seek(max(tail, quickHashSpan), io.SeekStart); err != nil {
+			return 0, err
+		}
+		if _, err := io.Copy(h, f); err != nil {
+			return 0, err
+		}
+	}
+	return h.Sum32(), nil
+}
+
+// writeZip archives every directory and regular file under root, with entry
+// names relative to root. The output is deterministic for an unchanged tree,
+// which is what lets prebuilt archives honor Range requests. Level 0 stores
+// files uncompressed. With more than one worker, files are compressed in
+// parallel and written in walk order.
+func writeZip(w io.Writer, root string, level, workers int, walker treeWalker) error {
+	zw := zip.NewWriter(w)
+	zw.RegisterCompressor(zip.Deflate, func(out io.Writer) (io.WriteCloser, error) {
+		buf := &pooledOutput{dst: out}
+		fw, err := flate.NewWriter(buf, level)
+		if err != nil {
+			return nil, err
+		}
+		return &pooledCompressor{w: fw, out: buf}, nil
+	})
+	var err error
+	if workers > 1 && level > 0 {
+		err = writeZipParallel(zw, root, level, workers, walker)
+	} else {
+		_, err = walker.walk(root, func(p string, d fs.DirEntry, err error) error {
+			if err != nil {
+				return err
+			}
+			header, err := zipHeader(root, p, d, level)
+			if err != nil || header == nil {
+				return err
+			}
+			return writeZipEntry(zw, header, p)
+		})
+	}
+	if err != nil {
+		return err
+	}
+	return zw.Close()
+}
+
+// zipHeader describes the entry for p, or returns nil if p is the root or
+// neither a directory nor a regular file.
+func zipHeader(root, p string, d fs.DirEntry, level int) (*zip.FileHeader, error) {
+	rel, err := filepath.Rel(root, p)
+	if err != nil || rel == "." || (!d.IsDir() && !d.Type().IsRegular()) {
+		return nil, err
+	}
+	info, err := d.Info()
+	if err != nil {
+		return nil, err
+	}
+	header, err := zip.FileInfoHeader(info)
+	if err != nil {
+		return nil, err
+	}
+	header.Name = filepath.ToSlash(rel)
+	if d.IsDir() {
+		header.Name += "/"
+		return header, nil
+	}
+	header.Method = zip.Deflate
+	if level == 0 {
+		header.Method = zip.Store
+	}
+	return header, nil
+}
+
+// writeZipEntry adds a directory entry, or the file at p compressed as it
+// is copied.
+func writeZipEntry(zw *zip.Writer, header *zip.FileHeader, p string) error {
+	dst, err := zw.CreateHeader(header)
+	if err != nil || strings.HasSuffix(header.Name, "/") {
+		return err
+	}
+	src, err := os.Open(p)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	_, err = io.Copy(dst, src)
+	return err
+}
+
+// zipParallelMax is the largest file compressed by a zip worker. Each one
+// is held in memory until its turn to be written, so bigger files are
+// compressed in line instead.
+const zipParallelMax = 8 << 20
+
+// zipJob is one archive entry on its way through the workers. Once done
+// delivers nil, data holds the compressed file, or is nil for entries
+// written in line.
+type zipJob struct {
+	header *zip.FileHeader
+	path   string
+	data   *bytes.Buffer
+	done   chan error
+}
+
+var zipBuffers = sync.Pool{New: func() any { return new(bytes.Buffer) }}
+
+// writeZipParallel walks root handing files to workers compressors while
+// entries are written out in walk order, at most workers ahead of the
+// writer, so the archive is byte for byte what one compressor would build
+// from the same compressed data.
+func writeZipParallel(zw *zip.Writer, root string, level, workers int, walker treeWalker) error {
+	pending := make(chan *zipJob, workers)
+	work := make(chan *zipJob)
+	stop := make(chan struct{})
+	defer close(stop)
+
+	for range workers {
+		go func() {
+			for job := range work {
+				var err error
+				compressPool.do(func() { err = compressZipJob(job, level) })
+				job.done <- err
+			}
+		}()
+	}
+
+	var walkErr error
+	go func() {
+		defer close(pending)
+		defer close(work)
+		_, walkErr = walker.walk(root, func(p string, d fs.DirEntry, err error) error {
+			if err != nil {
+				return err
+			}
+			header, err := zipHeader(root, p, d, level)
+			if err != nil || header == nil {
+				return err
+			}
+			job := &zipJob{header: header, path: p, done: make(chan error, 1)}
+			select {
+			case pending <- job:
+			case <-stop:
+				return fs.SkipAll
+			}
+			if d.IsDir() || header.UncompressedSize64 > zipParallelMax {
+				job.done <- nil
+				return nil
+			}
+			select {
+			case work <- job:
+			case <-stop:
+				return fs.SkipAll
+			}
+			return nil
+		})
+	}()
+
+	for job := range pending {
+		if err := <-job.done; err != nil {
+			return err
+		}
+		if job.data == nil {
+			if err := writeZipEntry(zw, job.header, job.path); err != nil {
+				return err
+			}
+			continue
+		}
+		dst, err := zw.CreateRaw(job.header)
+		if err == nil {
+			_, err = job.data.WriteTo(dst)
+		}
+		zipBuffers.Put(job.data)
+		if err != nil {
+			return err
+		}
+	}
+	return walkErr
+}
+
+// streamedHeader fills in what CreateHeader would for h, the data
+// descriptor flag, versions and timestamps, by passing it through a writer
+// that discards everything. An entry written with CreateRaw then comes out
+// exactly as a streamed one does.
+func streamedHeader(h *zip.FileHeader) error {
+	zw := zip.NewWriter(io.Discard)
+	zw.RegisterCompressor(h.Method, func(io.Writer) (io.WriteCloser, error) {
+		return discardCloser{}, nil
+	})
+	_, err := zw.CreateHeader(h)
+	return err
+}
+
+// discardCloser is a compressor that swallows its input.
+type discardCloser struct{}
+
+func (discardCloser) Write(b []byte) (int, error) { return len(b), nil }
+func (discardCloser) Close() error                { return nil }
+
+// compressZipJob deflates the job's file into a pooled buffer and fills in
+// the header, sizes and checksum a raw entry needs.
+func compressZipJob(job *zipJob, level int) error {
+	if err := streamedHeader(job.header); err != nil {
+		return err
+	}
+	src, err := os.Open(job.path)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	buf := zipBuffers.Get().(*bytes.Buffer)
+	buf.Reset()
+	fw, err := flate.NewWriter(buf, level)
+	if err != nil {
+		return err
+	}
+	crc := crc32.NewIEEE()
+	n, err := io.Copy(io.MultiWriter(fw, crc), src)
+	if err == nil {
+		err = fw.Close()
+	}
+	if err != nil {
+		zipBuffers.Put(buf)
+		return err
+	}
+	job.header.CRC32 = crc.Sum32()
+	job.header.UncompressedSize64 = uint64(n)
+	job.header.CompressedSize64 = uint64(buf.Len())
+	job.data = buf
+	return nil
+}
+
+// contentDisposition builds a Content-Disposition value naming the file
+// name as RFC 6266 describes: a quoted ASCII filename every client
+// understands, plus a UTF-8 filename* when the name needs more than ASCII.
+// Control characters are dropped, so no name can break the header.
+func contentDisposition(disposition, name string) string {
+	name = strings.Map(func(r rune) rune {
+		if r < 0x20 || r == 0x7f {
+			return -1
+		}
+		return r
+	}, name)
+
+	var ascii strings.Builder
+	plain := true
+	for _, r := range name {
+		switch {
+		case r >= utf8.RuneSelf:
+			ascii.WriteByte('_')
+			plain = false
+		case r == '"' || r == '\\':
+			ascii.WriteByte('\\')
+			ascii.WriteRune(r)
+		default:
+			ascii.WriteRune(r)
+		}
+	}
+	value := disposition + `; filename="` + ascii.String() + `"`
+	if plain {
+		return value
+	}
+
+	// RFC 8187 leaves only attr-chars unescaped
+	var ext strings.Builder
+	for _, b := range []byte(name) {
+		if b < utf8.RuneSelf && (b >= 'a' && b <= 'z' || b >= 'A' && b <= 'Z' || b >= '0' && b <= '9' || strings.IndexByte("!#$&+-.^_`|~", b) >= 0) {
+			ext.WriteByte(b)
+		} else {
+			fmt.Fprintf(&ext, "%%%02X", b)
+		}
+	}
+	return value + "; filename*=UTF-8''" + ext.String()
+}
+
+// serveTarGz streams the directory at dir as a gzip-compressed tarball. The
+// length is never known up front, so Range requests get the whole archive.
+func serveTarGz(w http.ResponseWriter, r *http.Request, dir string, level int, walker treeWalker) {
+	name := filepath.Base(dir) + ".tar.gz"
+	w.Header().Set("Content-Disposition", contentDisposition("attachment", name))
+	w.Header().Set("Content-Type", "application/gzip")
+	w.Header().Set("Accept-Ranges", "none")
+	w.Header().Set("Trailer", "X-Depth-Limited")
+	w.WriteHeader(http.StatusOK)
+	if r.Method == http.MethodHead {
+		return
+	}
+	buf := &pooledOutput{dst: w}
+	gzw, _ := gzip.NewWriterLevel(buf, level)
+	gz := &pooledCompressor{w: gzw, out: buf}
+	limited, err := writeTar(gz, dir, walker)
+	if closeErr := gz.Close(); err == nil {
+		err = closeErr
+	}
+	w.Header().Set("X-Depth-Limited", strconv.FormatBool(limited))
+	if err != nil {
+		// Headers are already sent; all we can do is cut the stream short
+		log.Printf("Error streaming archive: %v\n", err)
+	}
+}
+
+// writeTar archives every directory and regular file under root, with entry
+// names relative to root.
+func writeTar(w io.Writer, root string, walker treeWalker) (bool, error) {
+	tw := tar.NewWriter(w)
+	limited, err := walker.walk(root, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(root, p)
+		if err != nil || rel == "." {
+			return err
+		}
+		if !d.IsDir() && !d.Type().IsRegular() {
+			return nil
+		}
+
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		header, err := tar.FileInfoHeader(info, "")
+		if err != nil {
+			return err
+		}
+		header.Name = filepath.ToSlash(rel)
+		if d.IsDir() {
+			header.Name += "/"
+			return tw.WriteHeader(header)
+		}
+		if err := tw.WriteHeader(header); err != nil {
+			return err
+		}
+		src, err := os.Open(p)
+		if err != nil {
+			return err
+		}
+		defer src.Close()
+		_, err = io.CopyN(tw, src, header.Size)
+		return err
+	})
+	if err != nil {
+		return limited, err
+	}
+	return limited, tw.Close()
+}
+
+// entryHref builds the absolute link for a listing entry, keeping the trailing
+// slash that marks directories.
+func entryHref(basePath, dir, name string) string {
+	href := (&url.URL{Path: basePath + path.Join("/", dir, name)}).String()
+	if strings.HasSuffix(name, "/") {
+		href += "/"
+	}
+	return href
+}
+
+// redirectPath permanently redirects to target, keeping the query string.
+func redirectPath(w http.ResponseWriter, r *http.Request, target string) {
+	u := url.URL{Path: target, RawQuery: r.URL.RawQuery}
+	http.Redirect(w, r, u.String(), http.StatusMovedPermanently)
+}
+
+// defaultCSP allows the listing's inline styles and nothing else.
+const defaultCSP = "default-src 'none'; style-src 'unsafe-inline'; img-src 'self' data:; frame-ancestors 'none'"
+
+// headerFlags collects repeated -header flags.
+type headerFlags struct {
+	header http.Header
+}
+
+func (h *headerFlags) String() string {
+	var lines []string
+	for key, values := range h.header {
+		for _, value := range values {
+			lines = append(lines, key+": "+value)
+		}
+	}
+	return strings.Join(lines, ", ")
+}
+
+func (h *headerFlags) Set(s string) error {
+	key, value, ok := strings.Cut(s, ":")
+	key = strings.TrimSpace(key)
+	if !ok || key == "" {
+		return fmt.Errorf("expected \"Key: Value\", got %q", s)
+	}
+	if h.header == nil {
+		h.header = http.Header{}
+	}
+	h.header.Add(key, strings.TrimSpace(value))
+	return nil
+}
+
+// cidrList is a set of networks. It implements flag.Value so the CIDR
+// flags can be repeated or given comma-separated.
+type cidrList []netip.Prefix
+
+func (c *cidrList) String() string {
+	var cidrs []string
+	for _, prefix := range *c {
+		cidrs = append(cidrs, prefix.String())
+	}
+	return strings.Join(cidrs, ", ")
+}
+
+func (c *cidrList) Set(s string) error {
+	for _, cidr := range splitList(s) {
+		prefix, err := netip.ParsePrefix(cidr)
+		if err != nil {
+			// A bare address stands for just that host
+			addr, addrErr := netip.ParseAddr(cidr)
+			if addrErr != nil {
+				return fmt.Errorf("invalid CIDR %q: %w", cidr, err)
+			}
+			prefix = netip.PrefixFrom(addr, addr.BitLen())
+		}
+		*c = append(*c, prefix.Masked())
+	}
+	return nil
+}
+
+// allows reports whether ip is in one of the networks. An empty list
+// allows every address.
+func (c cidrList) allows(ip string) bool {
+	if len(c) == 0 {
+		return true
+	}
+	addr, err := netip.ParseAddr(ip)
+	if err != nil {
+		return false
+	}
+	addr = addr.Unmap()
+	for _, prefix := range c {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// mimeOverrides maps file extensions to content types. It implements
+// flag.Value so -mime can be repeated.
+type mimeOverrides map[string]string
+
+func (m *mimeOverrides) String() string {
+	var pairs []string
+	for ext, ctype := range *m {
+		pairs = append(pairs, ext+"="+ctype)
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, ", ")
+}
+
+func (m *mimeOverrides) Set(s string) error {
+	ext, ctype, ok := strings.Cut(s, "=")
+	ext, ctype = strings.ToLower(strings.TrimSpace(ext)), strings.TrimSpace(ctype)
+	if !ok || ext == "" || ctype == "" {
+		return fmt.Errorf("expected \".ext=type\", got %q", s)
+	}
+	if !strings.HasPrefix(ext, ".") {
+		ext = "." + ext
+	}
+	if _, _, err := mime.ParseMediaType(ctype); err != nil {
+		return fmt.Errorf("invalid content type %q: %w", ctype, err)
+	}
+	if *m == nil {
+		*m = mimeOverrides{}
+	}
+	(*m)[ext] = ctype
+	return nil
+}
+
+// loadMimeTypes reads a mime.types file, where each line is a content type
+// followed by the extensions it applies to, without dots.
+func loadMimeTypes(filename string) (map[string]string, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	types := map[string]string{}
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line, _, _ := strings.Cut(scanner.Text(), "#")
+		fields := strings.Fields(line)
+		if len(fields) < 2 {
+			continue
+		}
+		for _, ext := range fields[1:] {
+			types["."+strings.ToLower(ext)] = fields[0]
+		}
+	}
+	return types, scanner.Err()
+}
+
+// cacheRules maps file globs to Cache-Control directives. It implements
+// flag.Value so -cache-control can be repeated.
+type cacheRules []cacheRule
+
+type cacheRule struct {
+	pattern   string
+	directive string
+}
+
+func (c *cacheRules) String() string {
+	var rules []string
+	for _, rule := range *c {
+		rules = append(rules, rule.pattern+"="+rule.directive)
+	}
+	return strings.Join(rules, ", ")
+}
+
+func (c *cacheRules) Set(s string) error {
+	pattern, directive, ok := strings.Cut(s, "=")
+	pattern, directive = strings.TrimSpace(pattern), strings.TrimSpace(directive)
+	if !ok || pattern == "" || directive == "" {
+		return fmt.Errorf("expected \"glob=directive\", got %q", s)
+	}
+	if _, err := path.Match(pattern, ""); err != nil {
+		return fmt.Errorf("invalid glob %q: %w", pattern, err)
+	}
+	*c = append(*c, cacheRule{pattern: pattern, directive: directive})
+	return nil
+}
+
+// match returns the directive of the first rule matching urlPath, or "".
+// Patterns containing a slash match the whole path, others the base name.
+func (c cacheRules) match(urlPath string) string {
+	for _, rule := range c {
+		target := path.Base(urlPath)
+		if strings.Contains(rule.pattern, "/") {
+			target = strings.TrimPrefix(urlPath, "/")
+		}
+		if ok, _ := path.Match(rule.pattern, target); ok {
+			return rule.directive
+		}
+	}
+	return ""
+}
+
+// withHeaders adds the given headers to every response. They are applied
+// when the response is committed and only for keys the handler left unset,
+// so intentional headers such as Content-Type win.
+func withHeaders(next http.Handler, header http.Header) http.Handler {
+	if len(header) == 0 {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		next.ServeHTTP(&headerWriter{ResponseWriter: w, header: header}, r)
+	})
+}
+
+// statusRecorder captures the status and size of a response.
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+	bytes  int64
+}
+
+func (sr *statusRecorder) WriteHeader(status int) {
+	if sr.status == 0 {
+		sr.status = status
+	}
+	sr.ResponseWriter.WriteHeader(status)
+}
+
+func (sr *statusRecorder) Write(b []byte) (int, error) {
+	if sr.status == 0 {
+		sr.status = http.StatusOK
+	}
+	n, err := sr.ResponseWriter.Write(b)
+	sr.bytes += int64(n)
+	return n, err
+}
+
+func (sr *statusRecorder) ReadFrom(src io.Reader) (int64, error) {
+	if sr.status == 0 {
+		sr.status = http.StatusOK
+	}
+	n, err := io.Copy(sr.ResponseWriter, src)
+	sr.bytes += n
+	return n, err
+}
+
+func (sr *statusRecorder) Unwrap() http.ResponseWriter {
+	return sr.ResponseWriter
+}
+
+type accessRecord struct {
+	Time        time.Time `json:"time"`
+	ClientIP    string    `json:"client_ip"`
+	Method      string    `json:"method"`
+	Path        string    `json:"path"`
+	Query       string    `json:"query,omitempty"`
+	Proto       string    `json:"proto"`
+	Status      int       `json:"status"`
+	Bytes       int64     `json:"bytes"`
+	DurationMS  float64   `json:"duration_ms"`
+	ContentType string    `json:"content_type,omitempty"`
+	UserAgent   string    `json:"user_agent,omitempty"`
+	Referer     string    `json:"referer,omitempty"`
+}
+
+// withJSONAccessLog writes one JSON object per request to out. Writes are
+// serialized so each record stays on its own line.
+func withJSONAccessLog(next http.Handler, out io.Writer) http.Handler {
+	var mu sync.Mutex
+	enc := json.NewEncoder(out)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		rec := &statusRecorder{ResponseWriter: w}
+		next.ServeHTTP(rec, r)
+		if rec.status == 0 {
+			rec.status = http.StatusOK
+		}
+
+		entry := accessRecord{
+			Time:        start.UTC(),
+			ClientIP:    clientIP(r),
+			Method:      r.Method,
+			Path:        r.URL.Path,
+			Query:       r.URL.RawQuery,
+			Proto:       r.Proto,
+			Status:      rec.status,
+			Bytes:       rec.bytes,
+			DurationMS:  float64(time.Since(start).Microseconds()) / 1000,
+			ContentType: w.Header().Get("Content-Type"),
+			UserAgent:   r.UserAgent(),
+			Referer:     r.Referer(),
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		if err := enc.Encode(entry); err != nil {
+			log.Printf("Error writing access log: %v\n", err)
+		}
+	})
+}
+
+// withSlowLog logs a warning for every request that takes longer than
+// threshold, whether or not access logging is on.
+func withSlowLog(next http.Handler, threshold time.Duration) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		rec := &statusRecorder{ResponseWriter: w}
+		next.ServeHTTP(rec, r)
+		if elapsed := time.Since(start); elapsed > threshold {
+			if rec.status == 0 {
+				rec.status = http.StatusOK
+			}
+			log.Printf("Warning: slow request %s %s took %s (status %d, %d bytes)\n", r.Method, r.URL.Path, elapsed, rec.status, rec.bytes)
+		}
+	})
+}
+
+// quotaBuckets is how many slices a quota window is tracked in; usage
+// ages out one slice at a time.
+const quotaBuckets = 60
+
+// byteQuota limits how many bytes each client IP may move within a
+// sliding window. A nil quota is unlimited.
+type byteQuota struct {
+	limit   int64
+	window  time.Duration
+	mu      sync.Mutex
+	clients map[string][]quotaBucket
+}
+
+type quotaBucket struct {
+	start time.Time
+	bytes int64
+}
+
+// newByteQuota returns a quota of limit bytes per window, or nil if limit
+// is 0. Clients whose usage has aged out are dropped once per window until
+// stop is closed.
+func newByteQuota(limit int64, window time.Duration, stop <-chan struct{}) *byteQuota {
+	if limit <= 0 {
+		return nil
+	}
+	q := &byteQuota{limit: limit, window: window, clients: make(map[string][]quotaBucket)}
+	go func() {
+		ticker := time.NewTicker(window)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+			}
+			q.mu.Lock()
+			now := time.Now()
+			for ip := range q.clients {
+				q.prune(ip, now)
+			}
+			q.mu.Unlock()
+		}
+	}()
+	return q
+}
+
+// prune drops the buckets of ip that have left the window, and ip itself
+// once none remain. The caller holds q.mu.
+func (q *byteQuota) prune(ip string, now time.Time) []quotaBucket {
+	buckets := q.clients[ip]
+	i := 0
+	for i < len(buckets) && now.Sub(buckets[i].start) >= q.window {
+		i++
+	}
+	buckets = buckets[i:]
+	if len(buckets) == 0 {
+		delete(q.clients, ip)
+	} else {
+		q.clients[ip] = buckets
+	}
+	return buckets
+}
+
+// allow reports whether ip may move another n bytes, and if not, how long
+// until enough of its usage ages out to try again.
+func (q *byteQuota) allow(ip string, n int64) (bool, time.Duration) {
+	if q == nil {
+		return true, 0
+	}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	now := time.Now()
+	buckets := q.prune(ip, now)
+	var used int64
+	for _, b := range buckets {
+		used += b.bytes
+	}
+	if used < q.limit && used+n <= q.limit {
+		return true, 0
+	}
+	for _, b := range buckets {
+		used -= b.bytes
+		if used < q.limit && used+n <= q.limit {
+			return false, b.start.Add(q.window).Sub(now)
+		}
+	}
+	return false, q.window
+}
+
+// add charges n bytes to ip.
+func (q *byteQuota) add(ip string, n int64) {
+	if q == nil || n <= 0 {
+		return
+	}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	now := time.Now()
+	buckets := q.clients[ip]
+	if last := len(buckets) - 1; last >= 0 && now.Sub(buckets[last].start) < q.window/quotaBuckets {
+		buckets[last].bytes += n
+		return
+	}
+	q.clients[ip] = append(buckets, quotaBucket{start: now, bytes: n})
+}
+
+// declaredLength is the size an upload says it has: the larger of its
+// Content-Length and an X-Upload-Length header, which lets a ?validate=1
+// request describe a body it doesn't send. It is -1 if neither says.
+func declaredLength(r *http.Request) int64 {
+	n := r.ContentLength
+	if v, err := strconv.ParseInt(r.Header.Get("X-Upload-Length"), 10, 64); err == nil && v >= 0 {
+		n = max(n, v)
+	}
+	return n
+}
+
+// setUploadMtime gives the stored file at diskPath the modification time
+// the client sent in X-File-Mtime, as RFC 3339 or Unix seconds, so synced
+// files keep their source timestamps. A malformed header is ignored.
+func setUploadMtime(r *http.Request, diskPath string) {
+	v := r.Header.Get("X-File-Mtime")
+	if v == "" {
+		return
+	}
+	mtime, err := time.Parse(time.RFC3339Nano, v)
+	if err != nil {
+		secs, parseErr := strconv.ParseInt(v, 10, 64)
+		if parseErr != nil {
+			log.Printf("Warning: ignoring malformed X-File-Mtime %q\n", v)
+			return
+		}
+		mtime = time.Unix(secs, 0)
+	}
+	if err := os.Chtimes(diskPath, time.Time{}, mtime); err != nil {
+		log.Printf("Warning: unable to set mtime of %s: %v\n", diskPath, err)
+	}
+}
+
+// quotaReader charges request body bytes as handlers read them.
+type quotaReader struct {
+	io.ReadCloser
+	quota *byteQuota
+	ip    string
+}
+
+func (qr *quotaReader) Read(b []byte) (int, error) {
+	n, err := qr.ReadCloser.Read(b)
+	qr.quota.add(qr.ip, int64(n))
+	return n, err
+}
+
+// quotaWriter charges response body bytes as they are written.
+type quotaWriter struct {
+	http.ResponseWriter
+	quota *byteQuota
+	ip    string
+}
+
+func (qw *quotaWriter) Write(b []byte) (int, error) {
+	n, err := qw.ResponseWriter.Write(b)
+	qw.quota.add(qw.ip, int64(n))
+	return n, err
+}
+
+func (qw *quotaWriter) Unwrap() http.ResponseWriter {
+	return qw.ResponseWriter
+}
+
+// withByteQuotas refuses uploads and downloads with 429 once the client
+// IP has used up its quota for the window. Uploads declaring a length are
+// refused up front if they would overrun it; a transfer already under
+// way is allowed to finish and simply counts against the next one.
+func withByteQuotas(next http.Handler, upload, download *byteQuota) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ip := clientIP(r)
+		quota, n := download, int64(0)
+		if r.Method == http.MethodPut || r.Method == http.MethodPost {
+			quota, n = upload, max(declaredLength(r), 0)
+		}
+		if ok, retry := quota.allow(ip, n); !ok {
+			w.Header().Set("Retry-After", retryAfterSeconds(retry))
+			http.Error(w, "Byte quota exceeded", http.StatusTooManyRequests)
+			return
+		}
+		if upload != nil && r.Body != nil {
+			r.Body = &quotaReader{ReadCloser: r.Body, quota: upload, ip: ip}
+		}
+		if download != nil {
+			w = &quotaWriter{ResponseWriter: w, quota: download, ip: ip}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+type timingKey struct{}
+
+// serverTiming collects how long named phases of a request took. A nil
+// *serverTiming records nothing.
+type serverTiming struct {
+	start  time.Time
+	mu     sync.Mutex
+	phases []timingPhase
+}
+
+type timingPhase struct {
+	name string
+	dur  time.Duration
+}
+
+// timingFrom returns the request's timings, or nil if they aren't kept.
+func timingFrom(ctx context.Context) *serverTiming {
+	t, _ := ctx.Value(timingKey{}).(*serverTiming)
+	return t
+}
+
+// track starts timing the phase name and returns the function ending it.
+// A phase timed more than once adds up.
+func (t *serverTiming) track(name string) func() {
+	if t == nil {
+		return func() {}
+	}
+	start := time.Now()
+	return func() {
+		d := time.Since(start)
+		t.mu.Lock()
+		defer t.mu.Unlock()
+		for i := range t.phases {
+			if t.phases[i].name == name {
+				t.phases[i].dur += d
+				return
+			}
+		}
+		t.phases = append(t.phases, timingPhase{name: name, dur: d})
+	}
+}
+
+// header formats the phases so far, and the total time, as a Server-Timing
+// value with durations in milliseconds.
+func (t *serverTiming) header() string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	var metrics []string
+	for _, phase := range t.phases {
+		metrics = append(metrics, fmt.Sprintf("%s;dur=%.3f", phase.name, float64(phase.dur.Microseconds())/1000))
+	}
+	metrics = append(metrics, fmt.Sprintf("total;dur=%.3f", float64(time.Since(t.start).Microseconds())/1000))
+	return strings.Join(metrics, ", ")
+}
+
+// timingWriter adds the Server-Timing header as the response is committed.
+type timingWriter struct {
+	http.ResponseWriter
+	timing      *serverTiming
+	wroteHeader bool
+}
+
+func (tw *timingWriter) WriteHeader(status int) {
+	if !tw.wroteHeader {
+		tw.wroteHeader = true
+		tw.Header().Set("Server-Timing", tw.timing.header())
+	}
+	tw.ResponseWriter.WriteHeader(status)
+}
+
+func (tw *timingWriter) Write(b []byte) (int, error) {
+	if !tw.wroteHeader {
+		tw.WriteHeader(http.StatusOK)
+	}
+	return tw.ResponseWriter.Write(b)
+}
+
+func (tw *timingWriter) Unwrap() http.ResponseWriter {
+	return tw.ResponseWriter
+}
+
+// withServerTiming reports the phases handlers time in a Server-Timing
+// header. Phases that run while the body is sent, like reading a file or
+// compressing it, finish after the header has gone, so the complete
+// figures follow in a trailer where the response allows one.
+func withServerTiming(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		timing := &serverTiming{start: time.Now()}
+		tw := &timingWriter{ResponseWriter: w, timing: timing}
+		next.ServeHTTP(tw, r.WithContext(context.WithValue(r.Context(), timingKey{}, timing)))
+		if tw.wroteHeader {
+			w.Header().Set(http.TrailerPrefix+"Server-Timing", timing.header())
+		}
+	})
+}
+
+// headerWriter fills in default headers just before the response is
+// committed.
+type headerWriter struct {
+	http.ResponseWriter
+	header  http.Header
+	written bool
+}
+
+func (hw *headerWriter) apply() {
+	if hw.written {
+		return
+	}
+	hw.written = true
+	dst := hw.ResponseWriter.Header()
+	for key, values := range hw.header {
+		if _, ok := dst[key]; !ok {
+			dst[key] = values
+		}
+	}
+}
+
+func (hw *headerWriter) WriteHeader(status int) {
+	hw.apply()
+	hw.ResponseWriter.WriteHeader(status)
+}
+
+func (hw *headerWriter) Write(b []byte) (int, error) {
+	hw.apply()
+	return hw.ResponseWriter.Write(b)
+}
+
+// ReadFrom keeps the sendfile fast path of the underlying writer.
+func (hw *headerWriter) ReadFrom(src io.Reader) (int64, error) {
+	hw.apply()
+	return io.Copy(hw.ResponseWriter, src)
+}
+
+func (hw *headerWriter) Unwrap() http.ResponseWriter {
+	return hw.ResponseWriter
+}
+
+// compressPool bounds how many compressions run at once, so a burst of
+// compressed responses queues for the CPUs instead of thrashing them. It
+// is sized by -compress-workers.
+var compressPool workerPool
+
+// workerPool is a semaphore of worker slots. A nil pool never waits.
+type workerPool chan struct{}
+
+func newWorkerPool(size int) workerPool {
+	return make(workerPool, size)
+}
+
+// do runs fn once a slot is free.
+func (p workerPool) do(fn func()) {
+	if p != nil {
+		p <- struct{}{}
+		defer func() { <-p }()
+	}
+	fn()
+}
+
+// pooledOutput collects what a compressor produces while it holds a
+// compressPool slot, to be written to dst after the slot is given back,
+// so a slow client never keeps a worker waiting on the network.
+type pooledOutput struct {
+	dst io.Writer
+	buf bytes.Buffer
+}
+
+func (p *pooledOutput) Write(b []byte) (int, error) {
+	return p.buf.Write(b)
+}
+
+// drain sends the collected output on to dst.
+func (p *pooledOutput) drain() error {
+	_, err := p.buf.WriteTo(p.dst)
+	return err
+}
+
+// pooledCompressor runs w, a compressor writing into out, in compressPool.
+type pooledCompressor struct {
+	w   io.WriteCloser
+	out *pooledOutput
+}
+
+func (c *pooledCompressor) Write(b []byte) (int, error) {
+	var n int
+	var err error
+	compressPool.do(func() { n, err = c.w.Write(b) })
+	if err != nil {
+		return n, err
+	}
+	return n, c.out.drain()
+}
+
+func (c *pooledCompressor) Close() error {
+	var err error
+	compressPool.do(func() { err = c.w.Close() })
+	if drainErr := c.out.drain(); err == nil {
+		err = drainErr
+	}
+	return err
+}
+
+// gzipWriters recycles compressors between responses.
+var gzipWriters = sync.Pool{New: func() any { return gzip.NewWriter(io.Discard) }}
+
+// withGzip compresses responses for clients that accept gzip. Output is
+// compressed as it is written, so large listings and files stream instead
+// of being buffered. Range and HEAD requests pass through untouched so
+// offsets and lengths keep referring to the stored bytes. Responses under
+// minSize bytes, judged by Content-Length or by buffering that much when
+// the length isn't known, are sent as they are. Clients sending TE:
+// trailers get the length and SHA-256 of the uncompressed body in
+// trailers, to check a compressed stream arrived whole. Compressed
+// responses carry a strong ETag of their own, see gzipETag.
+func withGzip(next http.Handler, minSize int64) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Add("Vary", "Accept-Encoding")
+		if r.Method == http.MethodHead || r.Header.Get("Range") != "" || !acceptsGzip(r) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		gw := &gzipWriter{ResponseWriter: w, minSize: minSize, trailers: acceptsTrailers(r), timing: timingFrom(r.Context())}
+		// A client revalidating a compressed copy sends its ETag back, which
+		// the handler only knows in its uncompressed form
+		if inm := r.Header.Get("If-None-Match"); strings.Contains(inm, gzipETagSuffix) {
+			r = r.Clone(r.Context())
+			r.Header.Set("If-None-Match", strings.ReplaceAll(inm, gzipETagSuffix+`"`, `"`))
+			gw.gzipRevalidated = true
+		}
+		defer gw.Close()
+		next.ServeHTTP(gw, r)
+	})
+}
+
+// acceptsGzip reports whether the Accept-Encoding header allows gzip.
+func acceptsGzip(r *http.Request) bool {
+	for _, coding := range strings.Split(r.Header.Get("Accept-Encoding"), ",") {
+		name, params, _ := strings.Cut(coding, ";")
+		name = strings.TrimSpace(name)
+		if name != "gzip" && name != "*" {
+			continue
+		}
+		q, ok := strings.CutPrefix(strings.TrimSpace(params), "q=")
+		if !ok {
+			return true
+		}
+		weight, err := strconv.ParseFloat(q, 64)
+		return err == nil && weight > 0
+	}
+	return false
+}
+
+// acceptsTrailers reports whether the TE header asks for trailers.
+func acceptsTrailers(r *http.Request) bool {
+	for _, coding := range strings.Split(r.Header.Get("TE"), ",") {
+		if strings.EqualFold(strings.TrimSpace(coding), "trailers") {
+			return true
+		}
+	}
+	return false
+}
+
+// gzipETagSuffix marks the ETag of a compressed representation.
+const gzipETagSuffix = "-gzip"
+
+// gzipETag derives the strong ETag of the compressed representation of
+// the response tagged etag. Unlike a weak W/ tag it still works with
+// If-Match, which etagMatches accepts it for.
+func gzipETag(etag string) string {
+	return strings.TrimSuffix(etag, `"`) + gzipETagSuffix + `"`
+}
+
+// incompressible lists content types that are already compressed.
+var incompressible = []string{"application/zip", "application/gzip", "application/x-gzip", "image/", "audio/", "video/"}
+
+// gzipWriter decides on compression when the header is written, based on
+// the status, content type and length the handler chose. Without a length
+// the decision waits until minSize bytes have been written or the handler
+// finishes.
+type gzipWriter struct {
+	http.ResponseWriter
+	gz          *gzip.Writer
+	minSize     int64
+	trailers    bool
+	timing      *serverTiming
+	out         *pooledOutput
+	sum         hash.Hash
+	length      int64
+	wroteHeader bool
+	status      int
+	pending     []byte
+	committed   bool
+	// gzipRevalidated is set when If-None-Match named a compressed ETag
+	gzipRevalidated bool
+}
+
+func (g *gzipWriter) WriteHeader(status int) {
+	if g.wroteHeader {
+		return
+	}
+	g.wroteHeader = true
+	g.status = status
+	h := g.Header()
+	switch length, err := strconv.ParseInt(h.Get("Content-Length"), 10, 64); {
+	case !g.compressible(status, h):
+		g.commit(false)
+	case err == nil:
+		g.commit(length >= g.minSize)
+	case g.minSize <= 0:
+		g.commit(true)
+	}
+}
+
+// commit sends the header, compressed or not.
+func (g *gzipWriter) commit(compress bool) {
+	g.committed = true
+	h := g.Header()
+	if compress {
+		h.Del("Content-Length")
+		h.Set("Content-Encoding", "gzip")
+		// The encoded bytes differ, so they get a validator of their own
+		if etag := h.Get("ETag"); strings.HasPrefix(etag, `"`) {
+			h.Set("ETag", gzipETag(etag))
+		}
+		if g.trailers {
+			h.Add("Trailer", "X-Uncompressed-Length")
+			h.Add("Trailer", "X-Content-SHA256")
+			g.sum = sha256.New()
+		}
+		g.out = &pooledOutput{dst: g.ResponseWriter}
+		g.gz = gzipWriters.Get().(*gzip.Writer)
+		g.gz.Reset(g.out)
+	} else if etag := h.Get("ETag"); g.status == http.StatusNotModified && g.gzipRevalidated && strings.HasPrefix(etag, `"`) {
+		h.Set("ETag", gzipETag(etag))
+	}
+	g.ResponseWriter.WriteHeader(g.status)
+}
+
+// release commits to whatever the buffered bytes call for and writes
+// them out.
+func (g *gzipWriter) release(compress bool) error {
+	g.commit(compress)
+	buf := g.pending
+	g.pending = nil
+	if len(buf) == 0 {
+		return nil
+	}
+	if g.gz != nil {
+		_, err := g.compress(buf)
+		return err
+	}
+	_, err := g.ResponseWriter.Write(buf)
+	return err
+}
+
+func (g *gzipWriter) compressible(status int, h http.Header) bool {
+	switch {
+	case status < 200, status == http.StatusNoContent, status == http.StatusPartialContent, status == http.StatusNotModified:
+		return false
+	case h.Get("Content-Encoding") != "", h.Get("Content-Range") != "":
+		return false
+	}
+	contentType := h.Get("Content-Type")
+	for _, prefix := range incompressible {
+		if strings.HasPrefix(contentType, prefix) && contentType != "image/svg+xml" {
+			return false
+		}
+	}
+	return true
+}
+
+func (g *gzipWriter) Write(b []byte) (int, error) {
+	if !g.wroteHeader {
+		// Sniff before compressing, or the server would sniff the gzip bytes
+		if g.Header().Get("Content-Type") == "" {
+			g.Header().Set("Content-Type", http.DetectContentType(b))
+		}
+		g.WriteHeader(http.StatusOK)
+	}
+	if !g.committed {
+		g.pending = append(g.pending, b...)
+		if int64(len(g.pending)) >= g.minSize {
+			if err := g.release(true); err != nil {
+				return 0, err
+			}
+		}
+		return len(b), nil
+	}
+	if g.gz != nil {
+		return g.compress(b)
+	}
+	return g.ResponseWriter.Write(b)
+}
+
+// compress writes b through the compressor, keeping count of the bytes
+// for the trailers.
+func (g *gzipWriter) compress(b []byte) (int, error) {
+	done := g.timing.track("compress")
+	var n int
+	var err error
+	compressPool.do(func() { n, err = g.gz.Write(b) })
+	done()
+	if g.sum != nil {
+		g.sum.Write(b[:n])
+		g.length += int64(n)
+	}
+	if err != nil {
+		return n, err
+	}
+	return n, g.out.drain()
+}
+
+// Flush pushes out whatever has been compressed so far. A response flushed
+// before reaching minSize is a stream of small pieces and goes out as is.
+func (g *gzipWriter) Flush() {
+	if g.wroteHeader && !g.committed {
+		_ = g.release(false)
+	}
+	if g.gz != nil {
+		compressPool.do(func() { _ = g.gz.Flush() })
+		_ = g.out.drain()
+	}
+	_ = http.NewResponseController(g.ResponseWriter).Flush()
+}
+
+// Close finishes the gzip stream and returns the compressor to the pool.
+// A response that stayed under minSize is sent uncompressed with its
+// length.
+func (g *gzipWriter) Close() {
+	if g.wroteHeader && !g.committed {
+		g.Header().Set("Content-Length", strconv.Itoa(len(g.pending)))
+		_ = g.release(false)
+	}
+	if g.gz == nil {
+		return
+	}
+	done := g.timing.track("compress")
+	compressPool.do(func() { _ = g.gz.Close() })
+	done()
+	_ = g.out.drain()
+	if g.sum != nil {
+		g.Header().Set("X-Uncompressed-Length", strconv.FormatInt(g.length, 10))
+		g.Header().Set("X-Content-SHA256", hex.EncodeToString(g.sum.Sum(nil)))
+	}
+	gzipWriters.Put(g.gz)
+	g.gz = nil
+}
+
+func (g *gzipWriter) Unwrap() http.ResponseWriter {
+	return g.ResponseWriter
+}
+
+// withoutTrace answers TRACE and TRACK with 405 before authentication or
+// routing see them. Go never echoes TRACE requests itself, but scanners flag
+// anything other than an explicit refusal.
+func withoutTrace(next http.Handler, allow string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodTrace || r.Method == "TRACK" {
+			methodNotAllowed(w, allow)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// methodNotAllowed refuses the request, listing the methods that are
+// served.
+func methodNotAllowed(w http.ResponseWriter, allow string) {
+	w.Header().Set("Allow", allow)
+	http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+}
+
+// apiFeatures is what openAPISpec needs to know about this deployment.
+type apiFeatures struct {
+	Version   string
+	BasePath  string
+	Upload    bool
+	Delete    bool
+	Metrics   bool
+	BasicAuth bool
+}
+
+// openAPISpec describes the routes this server answers, leaving out the
+// operations switched off by flags.
+func openAPISpec(f apiFeatures) map[string]any {
+	query := func(name, description string) map[string]any {
+		return map[string]any{"name": name, "in": "query", "required": false, "description": description, "schema": map[string]string{"type": "string"}}
+	}
+	target := map[string]any{"name": "path", "in": "path", "required": true, "schema": map[string]string{"type": "string"}}
+	text := func(description string) map[string]any {
+		return map[string]any{"description": description, "content": map[string]any{"text/plain": map[string]any{}}}
+	}
+
+	item := map[string]any{
+		"parameters": []any{target},
+		"get": map[string]any{
+			"summary": "Download a file or list a directory",
+			"parameters": []any{
+				query("format", "json, text, rss, sync, zip or tar.gz"),
+				query("sort", "name, modtime or size, optionally suffixed -desc"),
+				query("after", "Cursor: list entries named after this"),
+				query("limit", "Page size for cursor pagination"),
+				query("modified-since", "RFC 3339 time; only newer entries are listed"),
+				query("type", "dir or file to list only directories or only files"),
+				query("recursive", "1 to list every file in the subtree by its relative path, in cursor pages"),
+				query("manifest", "1 for a recursive JSON manifest of files"),
+				query("since", "RFC 3339 time filtering the manifest"),
+				query("checksum", "md5, sha1 or sha256 digest of a file, or tree for a digest of a directory's contents"),
+				query("stat", "1 for file metadata as JSON"),
+				query("download", "1 to have browsers save the file instead of showing it"),
+				query("head", "First N lines of a text file"),
+				query("tail", "Last N lines of a text file"),
+				query("unit", "lines or bytes for head and tail"),
+				query("quota", "Disk usage report"),
+			},
+			"responses": map[string]any{"200": text("File contents or directory listing"), "304": text("Not modified"), "403": text("Forbidden"), "404": text("Not found")},
+		},
+	}
+	if f.Upload {
+		item["put"] = map[string]any{
+			"summary":     "Upload the body as a file; Content-Range resumes, If-Match replaces",
+			"parameters":  []any{query("validate", "1 to check the upload would be accepted without sending it")},
+			"requestBody": map[string]any{"content": map[string]any{"application/octet-stream": map[string]any{}}},
+			"responses":   map[string]any{"201": text("Created"), "202": text("Chunk received"), "204": text("Would be accepted"), "409": text("File already exists"), "412": text("File has changed"), "416": text("Chunk leaves a gap")},
+		}
+		item["post"] = map[string]any{
+			"summary":    "Multipart upload into the directory in the name field, or a batch action",
+			"parameters": []any{query("action", "batch-delete, batch-move or fetch"), query("validate", "1 to check an X-Target-Path upload would be accepted")},
+			"requestBody": map[string]any{"content": map[string]any{
+				"multipart/form-data": map[string]any{},
+				"application/json":    map[string]any{},
+			}},
+			"responses": map[string]any{"200": text("Uploaded"), "201": text("Fetched"), "409": text("File already exists"), "413": text("Upload too large")},
+		}
+	}
+	if f.Delete {
+		item["delete"] = map[string]any{
+			"summary":    "Delete a file or directory",
+			"parameters": []any{query("action", "abort to discard the partial data of a resumable upload")},
+			"responses":  map[string]any{"200": text("Deleted"), "403": text("Refused"), "404": text("Not found"), "412": text("File has changed")},
+		}
+	}
+
+	paths := map[string]any{
+		"/{path}":       item,
+		"/readyz":       map[string]any{"get": map[string]any{"summary": "Readiness probe", "responses": map[string]any{"200": text("ready")}}},
+		"/livez":        map[string]any{"get": map[string]any{"summary": "Liveness probe", "responses": map[string]any{"200": text("ok")}}},
+		"/openapi.json": map[string]any{"get": map[string]any{"summary": "This document", "responses": map[string]any{"200": map[string]any{"description": "OpenAPI description"}}}},
+	}
+	if f.Metrics {
+		paths["/metrics"] = map[string]any{"get": map[string]any{"summary": "Prometheus metrics", "responses": map[string]any{"200": text("Metrics")}}}
+	}
+
+	spec := map[string]any{
+		"openapi": "3.0.3",
+		"info":    map[string]any{"title": "gopi", "version": f.Version},
+		"paths":   paths,
+	}
+	if f.BasePath != "" {
+		spec["servers"] = []any{map[string]string{"url": f.BasePath}}
+	}
+	if f.BasicAuth {
+		spec["components"] = map[string]any{"securitySchemes": map[string]any{"basic": map[string]string{"type": "http", "scheme": "basic"}}}
+		spec["security"] = []any{map[string][]string{"basic": {}}}
+	}
+	return spec
+}
+
+// uploadProgress follows uploads that identify themselves with an
+// X-Upload-Id header. Finished uploads are kept for a minute so late
+// subscribers still see the outcome.
+type uploadProgress struct {
+	mu      sync.Mutex
+	uploads map[string]*progressState
+}
+
+type progressState struct {
+	received atomic.Int64
+	total    int64
+	done     atomic.Bool
+}
+
+// progressEvent is the data of each server-sent event.
+type progressEvent struct {
+	Received int64   `json:"received"`
+	Total    int64   `json:"total"`
+	Percent  float64 `json:"percent"`
+	Done     bool    `json:"done"`
+}
+
+// progressReader counts body bytes as handlers read them.
+type progressReader struct {
+	io.ReadCloser
+	state *progressState
+}
+
+func (pr *progressReader) Read(b []byte) (int, error) {
+	n, err := pr.ReadCloser.Read(b)
+	pr.state.received.Add(int64(n))
+	return n, err
+}
+
+func newUploadProgress() *uploadProgress {
+	return &uploadProgress{uploads: make(map[string]*progressState)}
+}
+
+// track starts following r if it carries an upload ID, scoped to the
+// user's home, and returns the function marking it finished. A nil
+// tracker follows nothing.
+func (p *uploadProgress) track(r *http.Request, home string) func() {
+	id := r.Header.Get("X-Upload-Id")
+	if p == nil || id == "" {
+		return func() {}
+	}
+	key := home + "/" + id
+	state := &progressState{total: r.ContentLength}
+	r.Body = &progressReader{ReadCloser: r.Body, state: state}
+	p.mu.Lock()
+	p.uploads[key] = state
+	p.mu.Unlock()
+
+	return func() {
+		state.done.Store(true)
+		time.AfterFunc(time.Minute, func() {
+			p.mu.Lock()
+			defer p.mu.Unlock()
+			if p.uploads[key] == state {
+				delete(p.uploads, key)
+			}
+		})
+	}
+}
+
+// wait returns the state of the upload with key, giving it up to timeout
+// to start. It returns nil if it never does.
+func (p *uploadProgress) wait(ctx context.Context, key string, timeout time.Duration) *progressState {
+	deadline := time.Now().Add(timeout)
+	for {
+		p.mu.Lock()
+		state := p.uploads[key]
+		p.mu.Unlock()
+		if state != nil || time.Now().After(deadline) {
+			return state
+		}
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-time.After(100 * time.Millisecond):
+		}
+	}
+}
+
+// streamProgress sends a progress event whenever the byte count moves, at
+// most every 200ms, and a final done event once the upload finishes or
+// the subscriber goes away.
+func streamProgress(w http.ResponseWriter, r *http.Request, state *progressState) {
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	rc := http.NewResponseController(w)
+	ticker := time.NewTicker(200 * time.Millisecond)
+	defer ticker.Stop()
+
+	last := int64(-1)
+	for {
+		event := progressEvent{Received: state.received.Load(), Total: state.total, Done: state.done.Load()}
+		if event.Total > 0 {
+			event.Percent = math.Round(float64(event.Received)*1000/float64(event.Total)) / 10
+		}
+		if event.Received != last || event.Done {
+			name := "progress"
+			if event.Done {
+				name = "done"
+			}
+			data, _ := json.Marshal(event)
+			if _, err := fmt.Fprintf(w, "event: %s\ndata: %s\n\n", name, data); err != nil {
+				return
+			}
+			_ = rc.Flush()
+			last = event.Received
+		}
+		if event.Done {
+			return
+		}
+		select {
+		case <-r.Context().Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// logRing keeps the most recent log lines and fans new ones out to
+// followers of /logs.
+type logRing struct {
+	mu    sync.Mutex
+	lines []string
+	next  int
+	full  bool
+	subs  map[chan string]struct{}
+}
+
+func newLogRing(size int) *logRing {
+	return &logRing{lines: make([]string, size), subs: make(map[chan string]struct{})}
+}
+
+// Write records each complete line of p. The log package hands over one
+// entry per call. A follower too slow to keep up misses lines rather
+// than stalling logging for everyone.
+func (l *logRing) Write(p []byte) (int, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for _, line := range strings.SplitAfter(string(p), "\n") {
+		if line == "" {
+			continue
+		}
+		l.lines[l.next] = line
+		l.next = (l.next + 1) % len(l.lines)
+		if l.next == 0 {
+			l.full = true
+		}
+		for ch := range l.subs {
+			select {
+			case ch <- line:
+			default:
+			}
+		}
+	}
+	return len(p), nil
+}
+
+// follow returns the buffered lines, oldest first, and a channel receiving
+// every line logged after them. The returned function stops following.
+func (l *logRing) follow() ([]string, <-chan string, func()) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	var backlog []string
+	if l.full {
+		backlog = append(backlog, l.lines[l.next:]...)
+	}
+	backlog = append(backlog, l.lines[:l.next]...)
+
+	ch := make(chan string, 64)
+	l.subs[ch] = struct{}{}
+	return backlog, ch, func() {
+		l.mu.Lock()
+		delete(l.subs, ch)
+		l.mu.Unlock()
+	}
+}
+
+// streamLogs replays the buffered log lines and then writes new ones as
+// they are logged, until the client goes away.
+func streamLogs(w http.ResponseWriter, r *http.Request, logs *logRing) {
+	backlog, lines, stop := logs.follow()
+	defer stop()
+
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	rc := http.NewResponseController(w)
+	for _, line := range backlog {
+		if _, err := io.WriteString(w, line); err != nil {
+			return
+		}
+	}
+	_ = rc.Flush()
+
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case line := <-lines:
+			if _, err := io.WriteString(w, line); err != nil {
+				return
+			}
+			_ = rc.Flush()
+		}
+	}
+}
+
+// defaultRobots asks every crawler to stay away.
+const defaultRobots = "User-agent: *\nDisallow: /\n"
+
+// withBasePath strips basePath from incoming requests so the server can sit
+// behind a proxy that forwards a subpath. Health checks are also answered at
+// the root so probes that bypass the proxy keep working, as is robots.txt,
+// which crawlers only look for there.
+func withBasePath(next http.Handler, basePath string) http.Handler {
+	if basePath == "" {
+		return next
+	}
+	stripped := http.StripPrefix(basePath, next)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.URL.Path == basePath:
+			http.Redirect(w, r, basePath+"/", http.StatusMovedPermanently)
+		case strings.HasPrefix(r.URL.Path, basePath+"/"):
+			stripped.ServeHTTP(w, r)
+		case r.URL.Path == "/readyz" || r.URL.Path == "/livez" || r.URL.Path == "/robots.txt":
+			next.ServeHTTP(w, r)
+		default:
+			http.NotFound(w, r)
+		}
+	})
+}
+
+// saveUpload writes src to filePath, refusing to replace an existing file.
+// The data goes to a temp file in tempDir, or beside filePath when empty,
+// and is linked into place once complete so readers never see a partial
+// upload.
+//
+// With rename set, a taken name is not an error: the upload is stored under
+// the first free "name (N).ext" instead. The path used is returned.
+func saveUpload(src io.Reader, filePath, tempDir string, rename bool) (string, error) {
+	// Check if the file already exists
+	log.Printf("Checking if file already exists: %s\n", filePath)
+	if _, err := os.Stat(filePath); err == nil && !rename {
+		log.Printf("File already exists: %s\n", filePath)
+		return "", &statusError{http.StatusConflict, "File already exists"}
+	}
+
+	if tempDir == "" {
+		tempDir = filepath.Dir(filePath)
+	}
+	tmpPath, err := writeTemp(src, tempDir)
+	if err != nil {
+		return "", err
+	}
+	defer os.Remove(tmpPath)
+
+	// Linking fails on a taken name, so two uploads racing for the same
+	// free name can't both claim it
+	target := filePath
+	for n := 1; ; n++ {
+		err = placeUpload(tmpPath, target)
+		var statusErr *statusError
+		if !rename || !errors.As(err, &statusErr) || statusErr.status != http.StatusConflict || n > 10000 {
+			break
+		}
+		target = conflictName(filePath, n)
+	}
+	if err != nil {
+		return "", err
+	}
+	log.Printf("File saved: %s\n", target)
+	return target, nil
+}
+
+// conflictName returns the nth alternative to p, as in "file (1).txt".
+func conflictName(p string, n int) string {
+	ext := filepath.Ext(p)
+	return fmt.Sprintf("%s (%d)%s", strings.TrimSuffix(p, ext), n, ext)
+}
+
+// replaceUpload atomically swaps the contents of filePath for src. The temp
+// file is staged beside filePath since a rename can't cross filesystems.
+func replaceUpload(src io.Reader, filePath string) error {
+	tmpPath, err := writeTemp(src, filepath.Dir(filePath))
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmpPath)
+	if err := os.Rename(tmpPath, filePath); err != nil {
+		log.Printf("Error replacing file: %v\n", err)
+		return withDetail(&statusError{http.StatusInternalServerError, "Unable to replace file"}, err)
+	}
+	log.Printf("File replaced: %s\n", filePath)
+	return nil
+}
+
+// writeTemp copies src into a new read-only temp file in dir and returns
+// its path. Nothing is left behind on failure.
+func writeTemp(src io.Reader, dir string) (string, error) {
+	tmp, err := os.CreateTemp(dir, ".gopi-upload-*.tmp")
+	if err != nil {
+		log.Printf("Error creating temp file: %v\n", err)
+		return "", withDetail(&statusError{http.StatusInternalServerError, "Unable to create file"}, err)
+	}
+
+	// Copy the uploaded file to the temp file. The part size is only known
+	// once the parser has read it, so success is judged by the copy itself.
+	_, err = io.Copy(tmp, src)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Chmod(tmp.Name(), 0444)
+	}
+	if err != nil {
+		log.Printf("Error copying file: %v\n", err)
+		os.Remove(tmp.Name())
+		return "", copyError(err)
+	}
+	return tmp.Name(), nil
+}
+
+// placeUpload hard-links the finished temp file to filePath, which fails
+// rather than clobbering a file that appeared meanwhile. A temp dir on
+// another filesystem falls back to copying.
+func placeUpload(tmpPath, filePath string) error {
+	err := os.Link(tmpPath, filePath)
+	switch {
+	case err == nil:
+		return nil
+	case errors.Is(err, fs.ErrExist):
+		log.Printf("File already exists: %s\n", filePath)
+		return &statusError{http.StatusConflict, "File already exists"}
+	case !errors.Is(err, syscall.EXDEV):
+		log.Printf("Error linking upload into place: %v\n", err)
+		return withDetail(&statusError{http.StatusInternalServerError, "Unable to create file"}, err)
+	}
+
+	src, err := os.Open(tmpPath)
+	if err != nil {
+		log.Printf("Error reopening temp file: %v\n", err)
+		return withDetail(&statusError{http.StatusInternalServerError, "Unable to create file"}, err)
+	}
+	defer src.Close()
+	dst, err := os.OpenFile(filePath, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0444)
+	if errors.Is(err, fs.ErrExist) {
+		return &statusError{http.StatusConflict, "File already exists"}
+	}
+	if err != nil {
+		log.Printf("Error creating destination file: %v\n", err)
+		return withDetail(&statusError{http.StatusInternalServerError, "Unable to create file"}, err)
+	}
+	_, err = io.Copy(dst, src)
+	if closeErr := dst.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		log.Printf("Error copying file: %v\n", err)
+		// Delete the partially written file
+		if removeErr := os.Remove(filePath); removeErr != nil {
+			log.Printf("Error removing partial file: %v\n", removeErr)
+		}
+		return copyError(err)
+	}
+	return nil
+}
+
+// writeChunk writes length bytes from src into the file at partPath at
+// offset start, creating the file if needed. It returns how many bytes were
+// written; a short body is an error.
+func writeChunk(partPath string, src io.Reader, start, length int64) (int64, error) {
+	f, err := os.OpenFile(partPath, os.O_WRONLY|os.O_CREATE, 0644)
+	if err != nil {
+		log.Printf("Error opening partial upload: %v\n", err)
+		return 0, withDetail(&statusError{http.StatusInternalServerError, "Unable to create file"}, err)
+	}
+	n, err := io.Copy(io.NewOffsetWriter(f, start), io.LimitReader(src, length))
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil && n < length {
+		return n, &statusError{http.StatusBadRequest, "Chunk shorter than its Content-Range"}
+	}
+	if err != nil {
+		log.Printf("Error writing chunk: %v\n", err)
+		return n, copyError(err)
+	}
+	return n, nil
+}
+
+// parseContentRange parses a "bytes start-end/total" Content-Range header.
+// The total length must be known and the range must lie inside it.
+func parseContentRange(s string) (start, end, total int64, err error) {
+	spec, ok := strings.CutPrefix(s, "bytes ")
+	rng, size, ok2 := strings.Cut(spec, "/")
+	first, last, ok3 := strings.Cut(rng, "-")
+	if !ok || !ok2 || !ok3 {
+		return 0, 0, 0, fmt.Errorf("malformed Content-Range %q", s)
+	}
+	if start, err = strconv.ParseInt(first, 10, 64); err != nil {
+		return 0, 0, 0, err
+	}
+	if end, err = strconv.ParseInt(last, 10, 64); err != nil {
+		return 0, 0, 0, err
+	}
+	if total, err = strconv.ParseInt(size, 10, 64); err != nil {
+		return 0, 0, 0, err
+	}
+	if start < 0 || end < start || end >= total {
+		return 0, 0, 0, fmt.Errorf("range %d-%d outside length %d", start, end, total)
+	}
+	return start, end, total, nil
+}
+
+// partsDirName is the directory at the top of the prefix that holds the
+// .part files of resumable uploads in progress.
+const partsDirName = ".gopi-parts"
+
+// internalDirs are the directories at the top of the prefix that gopi keeps
+// its own state in. Clients can neither list nor reach them.
+var internalDirs = []string{partsDirName, casDirName}
+
+// errInternalPath is returned for paths inside one of the internalDirs.
+var errInternalPath = &statusError{http.StatusNotFound, "File or directory not found"}
+
+// isInternalPath reports whether p is, or is inside, one of the
+// internalDirs of prefix.
+func isInternalPath(prefix, p string) bool {
+	for _, name := range internalDirs {
+		if withinRoot(filepath.Join(prefix, name), p) {
+			return true
+		}
+	}
+	return false
+}
+
+// partFile names the .part file in partsDir that collects the resumable
+// upload to filePath. The name is derived from the whole target path, so
+// uploads to the same name in different directories don't collide.
+func partFile(partsDir, filePath string) string {
+	sum := sha256.Sum256([]byte(filePath))
+	return filepath.Join(partsDir, hex.EncodeToString(sum[:])+".part")
+}
+
+// removeStaleParts deletes the resumable upload .part files in partsDir
+// that haven't been written to for ttl, holding each one's lock so a chunk
+// arriving meanwhile isn't lost. It returns how many it removed.
+func removeStaleParts(partsDir string, ttl time.Duration, locks *pathLocks) int {
+	files, _ := os.ReadDir(partsDir)
+	removed := 0
+	for _, file := range files {
+		if !file.Type().IsRegular() || !strings.HasSuffix(file.Name(), ".part") {
+			continue
+		}
+		p := filepath.Join(partsDir, file.Name())
+		unlock := locks.lock(p)
+		if info, err := os.Stat(p); err == nil && time.Since(info.ModTime()) > ttl {
+			if err := os.Remove(p); err == nil {
+				removed++
+			}
+		}
+		unlock()
+	}
+	return removed
+}
+
+// pathLocks hands out one mutex per path so that writers to the same file
+// take turns. Entries are dropped once nobody holds or waits for them.
+type pathLocks struct {
+	mu    sync.Mutex
+	locks map[string]*pathLock
+}
+
+type pathLock struct {
+	sync.Mutex
+	refs int
+}
+
+func newPathLocks() *pathLocks {
+	return &pathLocks{locks: make(map[string]*pathLock)}
+}
+
+// lock blocks until p is free and returns the function releasing it.
+func (l *pathLocks) lock(p string) (unlock func()) {
+	l.mu.Lock()
+	pl, ok := l.locks[p]
+	if !ok {
+		pl = &pathLock{}
+		l.locks[p] = pl
+	}
+	pl.refs++
+	l.mu.Unlock()
+
+	pl.Lock()
+	return func() {
+		pl.Unlock()
+		l.mu.Lock()
+		if pl.refs--; pl.refs == 0 {
+			delete(l.locks, p)
+		}
+		l.mu.Unlock()
+	}
+}
+
+// copyError maps a failed upload copy to the status reported to the client.
+func copyError(err error) error {
+	var maxBytesErr *http.MaxBytesError
+	if errors.As(err, &maxBytesErr) {
+		return &statusError{http.StatusRequestEntityTooLarge, "Upload too large"}
+	}
+	if errors.Is(err, syscall.ENOSPC) {
+		return &statusError{http.StatusInsufficientStorage, "Insufficient storage: the disk is full"}
+	}
+	return withDetail(&statusError{http.StatusInternalServerError, "Error copying file"}, err)
+}
+
+// fetchPolicy restricts which remote URLs ?action=fetch may download.
+type fetchPolicy struct {
+	schemes []string
+	hosts   []string
+	maxSize int64
+	timeout time.Duration
+}
+
+// allowed reports whether u uses a permitted scheme and host. Host entries
+// are exact names or "*.domain" for any subdomain.
+func (p *fetchPolicy) allowed(u *url.URL) bool {
+	schemeOK := false
+	for _, scheme := range p.schemes {
+		if strings.EqualFold(u.Scheme, scheme) {
+			schemeOK = true
+		}
+	}
+	if !schemeOK {
+		return false
+	}
+	host := strings.ToLower(u.Hostname())
+	for _, allowed := range p.hosts {
+		allowed = strings.ToLower(allowed)
+		if host == allowed || (strings.HasPrefix(allowed, "*.") && strings.HasSuffix(host, allowed[1:])) {
+			return true
+		}
+	}
+	return false
+}
+
+// open starts downloading rawURL, re-checking the policy on every redirect.
+// The returned body fails once it grows past the size limit.
+func (p *fetchPolicy) open(ctx context.Context, rawURL string) (io.ReadCloser, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil || !p.allowed(u) {
+		return nil, &statusError{http.StatusForbidden, "URL is not allowed"}
+	}
+
+	client := &http.Client{
+		Timeout: p.timeout,
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			if len(via) >= 10 || !p.allowed(req.URL) {
+				return errors.New("redirect not allowed")
+			}
+			return nil
+		},
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		return nil, &statusError{http.StatusBadRequest, "Invalid URL"}
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		log.Printf("Error fetching %s: %v\n", rawURL, err)
+		return nil, &statusError{http.StatusBadGateway, "Unable to fetch URL"}
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, &statusError{http.StatusBadGateway, fmt.Sprintf("Remote responded %s", resp.Status)}
+	}
+	if resp.ContentLength > p.maxSize {
+		resp.Body.Close()
+		return nil, &statusError{http.StatusRequestEntityTooLarge, "Upload too large"}
+	}
+	return http.MaxBytesReader(nil, resp.Body, p.maxSize), nil
+}
+
+// usageTTL bounds how stale the cached disk usage may get before the prefix
+// is walked again.
+const usageTTL = 30 * time.Second
+
+// diskUsage caches the number of bytes stored under root. Uploads adjust the
+// cached figure in place; deletes and moves drop it so it is recomputed.
+// Uploads still in flight hold their expected size in pending so concurrent
+// ones cannot together overrun the limit.
+type diskUsage struct {
+	root  string
+	limit int64
+
+	mu       sync.Mutex
+	bytes    int64
+	pending  int64
+	computed time.Time
+}
+
+func (u *diskUsage) current() (int64, error) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	return u.currentLocked()
+}
+
+func (u *diskUsage) currentLocked() (int64, error) {
+	if !u.computed.IsZero() && time.Since(u.computed) < usageTTL {
+		return u.bytes, nil
+	}
+	// The quota counts everything, hidden or deep
+	size, _, _, err := treeStats(u.root, treeWalker{})
+	if err != nil {
+		return 0, err
+	}
+	u.bytes, u.computed = size, time.Now()
+	return size, nil
+}
+
+// reserve holds n bytes for an upload about to be stored, failing when they
+// would exceed the limit on top of what is stored and already held. Every
+// successful reserve must be paired with a release once the upload is done.
+func (u *diskUsage) reserve(n int64) error {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if u.limit > 0 {
+		used, err := u.currentLocked()
+		if err != nil {
+			// Failing open keeps uploads working if the walk hits a bad entry
+			log.Printf("Error computing disk usage: %v\n", err)
+		} else if used += u.pending; used >= u.limit || used+n > u.limit {
+			return &statusError{http.StatusInsufficientStorage, "Disk usage quota exceeded"}
+		}
+	}
+	u.pending += n
+	return nil
+}
+
+// release drops a hold taken by reserve. Bytes actually written are counted
+// separately through add.
+func (u *diskUsage) release(n int64) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	u.pending -= n
+}
+
+func (u *diskUsage) add(n int64) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	u.bytes += n
+}
+
+func (u *diskUsage) invalidate() {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	u.computed = time.Time{}
+}
+
+type quotaReport struct {
+	MaxDiskUsage *int64 `json:"max_disk_usage"`
+	Used         int64  `json:"used"`
+	Available    *int64 `json:"available"`
+}
+
+// sizeBuckets are the histogram upper bounds, in bytes, for transferred
+// file sizes.
+var sizeBuckets = []float64{1 << 10, 10 << 10, 100 << 10, 1 << 20, 10 << 20, 100 << 20, 1 << 30}
+
+// histogram is a minimal Prometheus-style cumulative histogram.
+type histogram struct {
+	mu     sync.Mutex
+	bounds []float64
+	counts []uint64
+	sum    float64
+	count  uint64
+}
+
+func newHistogram(bounds []float64) *histogram {
+	return &histogram{bounds: bounds, counts: make([]uint64, len(bounds))}
+}
+
+func (h *histogram) observe(v float64) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for i, bound := range h.bounds {
+		if v <= bound {
+			h.counts[i]++
+		}
+	}
+	h.sum += v
+	h.count++
+}
+
+func (h *histogram) writeTo(w io.Writer, name, help string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s histogram\n", name, help, name)
+	for i, bound := range h.bounds {
+		fmt.Fprintf(w, "%s_bucket{le=\"%s\"} %d\n", name, strconv.FormatFloat(bound, 'f', -1, 64), h.counts[i])
+	}
+	fmt.Fprintf(w, "%s_bucket{le=\"+Inf\"} %d\n", name, h.count)
+	fmt.Fprintf(w, "%s_sum %g\n%s_count %d\n", name, h.sum, name, h.count)
+}
+
+// metrics tracks transfer volume for the /metrics endpoint.
+type metrics struct {
+	uploadedBytes   atomic.Int64
+	downloadedBytes atomic.Int64
+	uploadSizes     *histogram
+	downloadSizes   *histogram
+}
+
+func newMetrics() *metrics {
+	return &metrics{
+		uploadSizes:   newHistogram(sizeBuckets),
+		downloadSizes: newHistogram(sizeBuckets),
+	}
+}
+
+func (m *metrics) observeUpload(n int64) {
+	m.uploadedBytes.Add(n)
+	m.uploadSizes.observe(float64(n))
+}
+
+// countDownload runs serve with a writer that counts the body bytes sent
+// and records them as one download.
+func (m *metrics) countDownload(w http.ResponseWriter, serve func(http.ResponseWriter)) {
+	cw := &countingWriter{ResponseWriter: w}
+	serve(cw)
+	m.downloadedBytes.Add(cw.n)
+	m.downloadSizes.observe(float64(cw.n))
+}
+
+func (m *metrics) writeTo(w io.Writer) {
+	fmt.Fprintf(w, "# HELP gopi_uploaded_bytes_total Bytes received in uploads.\n# TYPE gopi_uploaded_bytes_total counter\n")
+	fmt.Fprintf(w, "gopi_uploaded_bytes_total %d\n", m.uploadedBytes.Load())
+	fmt.Fprintf(w, "# HELP gopi_downloaded_bytes_total Bytes sent in file downloads.\n# TYPE gopi_downloaded_bytes_total counter\n")
+	fmt.Fprintf(w, "gopi_downloaded_bytes_total %d\n", m.downloadedBytes.Load())
+	m.uploadSizes.writeTo(w, "gopi_upload_file_size_bytes", "Sizes of uploaded files.")
+	m.downloadSizes.writeTo(w, "gopi_download_file_size_bytes", "Sizes of served file responses.")
+}
+
+// countingWriter counts response body bytes.
+type countingWriter struct {
+	http.ResponseWriter
+	n int64
+}
+
+func (cw *countingWriter) Write(b []byte) (int, error) {
+	n, err := cw.ResponseWriter.Write(b)
+	cw.n += int64(n)
+	return n, err
+}
+
+func (cw *countingWriter) ReadFrom(src io.Reader) (int64, error) {
+	n, err := io.Copy(cw.ResponseWriter, src)
+	cw.n += n
+	return n, err
+}
+
+func (cw *countingWriter) Unwrap() http.ResponseWriter {
+	return cw.ResponseWriter
+}
+
+// countingReader counts the bytes read through it.
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// uploadEvent is published once an upload has been written.
+type uploadEvent struct {
+	Path   string    `json:"path"`
+	Size   int64     `json:"size"`
+	SHA256 string    `json:"sha256"`
+	Time   time.Time `json:"time"`
+}
+
+// eventPublisher delivers one encoded event to an external system.
+type eventPublisher interface {
+	publish(ctx context.Context, payload []byte) error
+}
+
+// newEventPublisher picks the publisher for rawURL's scheme.
+func newEventPublisher(rawURL string) (eventPublisher, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	name := strings.TrimPrefix(u.Path, "/")
+	if u.Host == "" || name == "" {
+		return nil, fmt.Errorf("expected scheme://host:port/name, got %q", rawURL)
+	}
+	switch u.Scheme {
+	case "nats":
+		return &natsPublisher{addr: defaultPort(u.Host, "4222"), subject: name, user: u.User}, nil
+	case "redis":
+		return &redisPublisher{addr: defaultPort(u.Host, "6379"), stream: name, user: u.User}, nil
+	}
+	return nil, fmt.Errorf("unsupported scheme %q", u.Scheme)
+}
+
+// defaultPort adds port to hostport if it names none.
+func defaultPort(hostport, port string) string {
+	if _, _, err := net.SplitHostPort(hostport); err == nil {
+		return hostport
+	}
+	return net.JoinHostPort(strings.Trim(hostport, "[]"), port)
+}
+
+// uploadNotifier publishes upload events in the background, so a slow or
+// unreachable broker never holds up a response. Events that arrive while
+// the queue is full are dropped. A nil notifier publishes nothing.
+type uploadNotifier struct {
+	pub       eventPublisher
+	checksums *checksumCache
+	queue     chan pendingEvent
+}
+
+type pendingEvent struct {
+	path string
+	file string
+	at   time.Time
+}
+
+func newUploadNotifier(pub eventPublisher, checksums *checksumCache) *uploadNotifier {
+	n := &uploadNotifier{pub: pub, checksums: checksums, queue: make(chan pendingEvent, 256)}
+	go n.run()
+	return n
+}
+
+// notify queues an event for the upload stored at urlPath, whose bytes are
+// in file.
+func (n *uploadNotifier) notify(urlPath, file string) {
+	if n == nil {
+		return
+	}
+	select {
+	case n.queue <- pendingEvent{path: urlPath, file: file, at: time.Now()}:
+	default:
+		log.Printf("Warning: event queue full, dropping upload event for %s\n", urlPath)
+	}
+}
+
+// run checksums and publishes queued uploads one at a time.
+func (n *uploadNotifier) run() {
+	for pending := range n.queue {
+		info, err := os.Stat(pending.file)
+		var sum string
+		if err == nil {
+			sum, err = n.checksums.sum(pending.file, "sha256", info)
+		}
+		if err != nil {
+			log.Printf("Warning: not publishing upload event for %s: %v\n", pending.path, err)
+			continue
+		}
+		payload, _ := json.Marshal(uploadEvent{Path: pending.path, Size: info.Size(), SHA256: sum, Time: pending.at})
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		if err := n.pub.publish(ctx, payload); err != nil {
+			log.Printf("Warning: unable to publish upload event for %s: %v\n", pending.path, err)
+		}
+		cancel()
+	}
+}
+
+// dialBroker connects to addr, with the connection's deadline taken from
+// ctx.
+func dialBroker(ctx context.Context, addr string) (net.Conn, error) {
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		_ = conn.SetDeadline(deadline)
+	}
+	return conn, nil
+}
+
+// natsPublisher publishes to a NATS subject over the plain-text client
+// protocol, waiting for the PONG that confirms the server processed it.
+type natsPublisher struct {
+	addr    string
+	subject string
+	user    *url.Userinfo
+}
+
+func (p *natsPublisher) publish(ctx context.Context, payload []byte) error {
+	conn, err := dialBroker(ctx, p.addr)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	br := bufio.NewReader(conn)
+	if line, err := br.ReadString('\n'); err != nil {
+		return err
+	} else if !strings.HasPrefix(line, "INFO ") {
+		return fmt.Errorf("unexpected greeting %q", strings.TrimSpace(line))
+	}
+
+	opts := map[string]any{"verbose": false, "pedantic": false, "name": "gopi"}
+	if p.user != nil {
+		if password, ok := p.user.Password(); ok {
+			opts["user"], opts["pass"] = p.user.Username(), password
+		} else {
+			opts["auth_token"] = p.user.Username()
+		}
+	}
+	connect, _ := json.Marshal(opts)
+	if _, err := fmt.Fprintf(conn, "CONNECT %s\r\nPUB %s %d\r\n%s\r\nPING\r\n", connect, p.subject, len(payload), payload); err != nil {
+		return err
+	}
+	for {
+		line, err := br.ReadString('\n')
+		if err != nil {
+			return err
+		}
+		switch line = strings.TrimSpace(line); {
+		case line == "PONG":
+			return nil
+		case strings.HasPrefix(line, "-ERR"):
+			return fmt.Errorf("nats: %s", strings.TrimSpace(strings.TrimPrefix(line, "-ERR")))
+		}
+	}
+}
+
+// redisPublisher appends to a Redis stream with XADD, the event JSON in an
+// "event" field.
+type redisPublisher struct {
+	addr   string
+	stream string
+	user   *url.Userinfo
+}
+
+func (p *redisPublisher) publish(ctx context.Context, payload []byte) error {
+	conn, err := dialBroker(ctx, p.addr)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	br := bufio.NewReader(conn)
+	if p.user != nil {
+		args := []string{"AUTH", p.user.Username()}
+		if password, ok := p.user.Password(); ok {
+			args = append(args, password)
+			if p.user.Username() == "" {
+				args = []string{"AUTH", password}
+			}
+		}
+		if err := redisCommand(conn, br, args...); err != nil {
+			return err
+		}
+	}
+	return redisCommand(conn, br, "XADD", p.stream, "*", "event", string(payload))
+}
+
+// redisCommand sends one command and reads its reply, returning the error
+// the server answered with, if any.
+func redisCommand(conn net.Conn, br *bufio.Reader, args ...string) error {
+	var b strings.Builder
+	fmt.Fprintf(&b, "*%d\r\n", len(args))
+	for _, arg := range args {
+		fmt.Fprintf(&b, "$%d\r\n%s\r\n", len(arg), arg)
+	}
+	if _, err := io.WriteString(conn, b.String()); err != nil {
+		return err
+	}
+	line, err := br.ReadString('\n')
+	if err != nil {
+		return err
+	}
+	line = strings.TrimSpace(line)
+	switch {
+	case strings.HasPrefix(line, "-"):
+		return fmt.Errorf("redis: %s", line[1:])
+	case strings.HasPrefix(line, "$"):
+		// The reply to XADD is the new entry's ID as a bulk string
+		if n, err := strconv.Atoi(line[1:]); err == nil && n >= 0 {
+			_, err = br.Discard(n + 2)
+			return err
+		}
+	}
+	return nil
+}
+
+// auditLog appends one JSON object per mutating operation to a file. A nil
+// *auditLog discards records.
+type auditLog struct {
+	mu  sync.Mutex
+	enc *json.Encoder
+	f   *os.File
+}
+
+type auditRecord struct {
+	Time     time.Time `json:"time"`
+	ClientIP string    `json:"client_ip"`
+	User     string    `json:"user,omitempty"`
+	Op       string    `json:"op"`
+	Path     string    `json:"path"`
+	To       string    `json:"to,omitempty"`
+	Result   string    `json:"result"`
+}
+
+func openAuditLog(file string) (*auditLog, error) {
+	f, err := os.OpenFile(file, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return nil, err
+	}
+	return &auditLog{enc: json.NewEncoder(f), f: f}, nil
+}
+
+// record logs op on p with the outcome err, where nil means success.
+func (a *auditLog) record(r *http.Request, op, p string, err error) {
+	a.write(r, auditRecord{Op: op, Path: p}, err)
+}
+
+// recordMove logs a rename from one path to another.
+func (a *auditLog) recordMove(r *http.Request, from, to string, err error) {
+	a.write(r, auditRecord{Op: "move", Path: from, To: to}, err)
+}
+
+func (a *auditLog) write(r *http.Request, rec auditRecord, err error) {
+	if a == nil {
+		return
+	}
+	rec.Time = time.Now().UTC()
+	rec.ClientIP = clientIP(r)
+	rec.User = requestUser(r)
+	rec.Result = "ok"
+	if err != nil {
+		rec.Result = err.Error()
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if err := a.enc.Encode(rec); err != nil {
+		log.Printf("Error writing audit record: %v\n", err)
+	}
+}
+
+// Close closes the log file. A nil log has nothing to close.
+func (a *auditLog) Close() error {
+	if a == nil {
+		return nil
+	}
+	return a.f.Close()
+}
+
+// clientIP returns the host part of the request's remote address.
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// statusError is an error that knows which HTTP status it should be
+// reported with.
+type statusError struct {
+	status int
+	msg    string
+}
+
+func (e *statusError) Error() string { return e.msg }
+
+// verboseErrors adds the underlying cause to the messages writeError
+// sends, which helps in development but can leak details in production.
+var verboseErrors bool
+
+// detailedError is a client-facing error carrying the cause behind it.
+type detailedError struct {
+	*statusError
+	cause error
+}
+
+func (e *detailedError) Unwrap() error { return e.statusError }
+
+// withDetail attaches cause to se, to be shown with -verbose-errors.
+func withDetail(se *statusError, cause error) error {
+	return &detailedError{statusError: se, cause: cause}
+}
+
+// errReadOnlyFS is reported for writes the OS refuses because the prefix is
+// on a read-only mount, which retrying won't fix until it is remounted.
+var errReadOnlyFS = &statusError{http.StatusForbidden, "Forbidden: the filesystem is read-only; remount it read-write before retrying"}
+
+// writeError reports err to the client, using its status when it is a
+// *statusError and 500 otherwise. Only -verbose-errors shows the client
+// the cause of an error; unexpected errors are logged in full either way.
+func writeError(w http.ResponseWriter, err error) {
+	var se *statusError
+	var de *detailedError
+	cause := err
+	if errors.As(err, &de) {
+		cause = de.cause
+	}
+	switch {
+	case errors.Is(cause, syscall.EROFS):
+		log.Printf("Warning: write refused by read-only filesystem: %v\n", cause)
+		se = errReadOnlyFS
+	case !errors.As(err, &se):
+		log.Printf("Error: %v\n", err)
+		se = &statusError{http.StatusInternalServerError, "Internal server error"}
+	case de == nil:
+		cause = nil
+	}
+	msg := se.msg
+	if verboseErrors && cause != nil {
+		msg += ": " + cause.Error()
+	}
+	http.Error(w, msg, se.status)
+}
+
+// batchResult reports the outcome for one path of a batch operation.
+type batchResult struct {
+	Path  string `json:"path"`
+	To    string `json:"to,omitempty"`
+	OK    bool   `json:"ok"`
+	Error string `json:"error,omitempty"`
+}
+
+// batchMove is one rename requested through the batch-move action.
+type batchMove struct {
+	From      string `json:"from"`
+	To        string `json:"to"`
+	Overwrite bool   `json:"overwrite"`
+}
+
+// movePath renames from to to, both relative to the resolver's root. An
+// existing target is only replaced when overwrite is set; missing parent
+// directories of the target are created.
+func movePath(resolve pathResolver, from, to string, overwrite bool) error {
+	if isRootPath(from) || isRootPath(to) {
+		return &statusError{http.StatusForbidden, "Refusing to move root directory"}
+	}
+	src, err := resolveEntry(resolve, from)
+	if err != nil {
+		return err
+	}
+	dst, err := resolveEntry(resolve, to)
+	if err != nil {
+		return err
+	}
+	if _, err := os.Lstat(src); err != nil {
+		return &statusError{http.StatusNotFound, "File or directory not found"}
+	}
+	if _, err := os.Lstat(dst); err == nil && !overwrite {
+		return &statusError{http.StatusConflict, "Target already exists"}
+	}
+	if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+		log.Printf("Error creating target directory: %v\n", err)
+		return withDetail(&statusError{http.StatusInternalServerError, "Unable to create target directory"}, err)
+	}
+	if err := os.Rename(src, dst); err != nil {
+		log.Printf("Error moving: %v\n", err)
+		return withDetail(&statusError{http.StatusInternalServerError, "Unable to move"}, err)
+	}
+	return nil
+}
+
+// removePath deletes the file or directory at relPath beneath the
+// resolver's root. It refuses the root itself, wildcards and anything
+// resolving outside root. A non-empty ifMatch must match the ETag of a file
+// target.
+func removePath(resolve pathResolver, relPath, ifMatch string) error {
+	path, info, err := deleteTarget(resolve, relPath, ifMatch)
+	if err != nil {
+		return err
+	}
+	// Remove file or directory
+	var removeErr error
+	if info.IsDir() {
+		removeErr = os.RemoveAll(path)
+	} else {
+		removeErr = os.Remove(path)
+	}
+	if removeErr != nil {
+		log.Printf("Error deleting: %v\n", removeErr)
+		return withDetail(&statusError{http.StatusInternalServerError, "Unable to delete"}, removeErr)
+	}
+	return nil
+}
+
+// deleteTarget runs the safety checks for deleting relPath and returns the
+// path to remove along with what it is.
+func deleteTarget(resolve pathResolver, relPath, ifMatch string) (string, os.FileInfo, error) {
+	// Safety checks: block root, empty, or suspicious paths
+	if relPath == "/" || relPath == "" || relPath == "*" || relPath == "/*" {
+		return "", nil, &statusError{http.StatusForbidden, "Refusing to delete root or wildcard path"}
+	}
+	if isRootPath(relPath) {
+		return "", nil, &statusError{http.StatusForbidden, "Refusing to delete root directory"}
+	}
+	// Prevent attempts to delete outside the prefix
+	path, err := resolveEntry(resolve, relPath)
+	if err != nil {
+		return "", nil, err
+	}
+	info, err := os.Lstat(path)
+	if err != nil {
+		return "", nil, &statusError{http.StatusNotFound, "File or directory not found"}
+	}
+	if ifMatch != "" && !info.IsDir() && !etagMatches(ifMatch, fileETag(info)) {
+		return "", nil, &statusError{http.StatusPreconditionFailed, "File has changed"}
+	}
+	return path, info, nil
+}
+
+// preferAsync reports whether the client asked, with Prefer:
+// respond-async, to be answered before the work is done.
+func preferAsync(r *http.Request) bool {
+	for _, prefs := range r.Header.Values("Prefer") {
+		for _, pref := range strings.Split(prefs, ",") {
+			if strings.EqualFold(strings.TrimSpace(pref), "respond-async") {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// deleteJobs tracks directory deletions running in the background. Jobs
+// are keyed by the requesting user's home, so users only see their own,
+// and forgotten ten minutes after they finish.
+type deleteJobs struct {
+	mu   sync.Mutex
+	jobs map[string]*deleteJob
+}
+
+type deleteJob struct {
+	ID      string
+	path    string
+	removed atomic.Int64
+	done    atomic.Bool
+	err     atomic.Value
+}
+
+// jobStatus is the JSON form of a deleteJob.
+type jobStatus struct {
+	ID      string `json:"id"`
+	Path    string `json:"path"`
+	Removed int64  `json:"removed"`
+	Done    bool   `json:"done"`
+	Error   string `json:"error,omitempty"`
+}
+
+func newDeleteJobs() *deleteJobs {
+	return &deleteJobs{jobs: make(map[string]*deleteJob)}
+}
+
+// start deletes dir in the background, reporting to finished once it is
+// gone or has failed. urlPath is the name the job reports.
+func (j *deleteJobs) start(home, urlPath, dir string, finished func(error)) *deleteJob {
+	id := make([]byte, 8)
+	_, _ = rand.Read(id)
+	job := &deleteJob{ID: hex.EncodeToString(id), path: urlPath}
+	key := home + "/" + job.ID
+	j.mu.Lock()
+	j.jobs[key] = job
+	j.mu.Unlock()
+
+	go func() {
+		err := removeTree(dir, func() { job.removed.Add(1) })
+		if err != nil {
+			log.Printf("Error deleting %s: %v\n", dir, err)
+			job.err.Store("Unable to delete")
+		}
+		job.done.Store(true)
+		finished(err)
+		time.AfterFunc(10*time.Minute, func() {
+			j.mu.Lock()
+			delete(j.jobs, key)
+			j.mu.Unlock()
+		})
+	}()
+	return job
+}
+
+func (j *deleteJobs) get(key string) *deleteJob {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return j.jobs[key]
+}
+
+func (job *deleteJob) status() jobStatus {
+	s := jobStatus{ID: job.ID, Path: job.path, Removed: job.removed.Load(), Done: job.done.Load()}
+	s.Error, _ = job.err.Load().(string)
+	return s
+}
+
+// removeTree deletes dir and everything under it, a batch of entries at a
+// time, calling removed after each entry goes. Symlinks are removed, not
+// followed.
+func removeTree(dir string, removed func()) error {
+	for {
+		f, err := os.Open(dir)
+		if err != nil {
+			return err
+		}
+		// Reopening for every batch means entries deleted meanwhile can't
+		// throw the directory read off
+		batch, err := f.ReadDir(1024)
+		f.Close()
+		if len(batch) == 0 {
+			if err != nil && err != io.EOF {
+				return err
+			}
+			break
+		}
+		for _, entry := range batch {
+			p := filepath.Join(dir, entry.Name())
+			if entry.IsDir() {
+				err = removeTree(p, removed)
+			} else if err = os.Remove(p); err == nil {
+				removed()
+			}
+			if err != nil {
+				return err
+			}
+		}
+	}
+	if err := os.Remove(dir); err != nil {
+		return err
+	}
+	removed()
+	return nil
+}
+
+// fileETag derives a strong validator from a file's size and modification
+// time. It depends on nothing else, no process state, salt or inode, so the
+// same file gets the same ETag from every instance and across restarts, and
+// a download resumed with If-Range after a restart carries on where it
+// left off. Changing the format would break those resumptions, so it must
+// stay as it is.
+func fileETag(info os.FileInfo) string {
+	return fmt.Sprintf(`"%x-%x"`, info.ModTime().UnixNano(), info.Size())
+}
+
+// etagMatches reports whether an If-Match header value matches etag, or
+// the ETag -gzip gave its compressed form.
+func etagMatches(header, etag string) bool {
+	for _, candidate := range strings.Split(header, ",") {
+		candidate = strings.TrimSpace(candidate)
+		if candidate == "*" || candidate == etag || candidate == gzipETag(etag) {
+			return true
+		}
+	}
+	return false
+}
+
+// errEscapesRoot is returned for paths that lead outside the prefix.
+var errEscapesRoot = &statusError{http.StatusForbidden, "Path is outside the prefix"}
+
+// pathResolver maps a request-relative path to a filesystem path beneath a
+// root, failing with errEscapesRoot when it would leave the root.
+type pathResolver func(rel string) (string, error)
+
+// errOutsideUploadDir is returned for uploads aimed outside -upload-dir.
+var errOutsideUploadDir = &statusError{http.StatusForbidden, "Uploads are only accepted under the upload directory"}
+
+// restrictResolver narrows resolve to paths at or beneath dir, failing with
+// errOutsideUploadDir for the rest. A dir of "/" restricts nothing.
+func restrictResolver(resolve pathResolver, dir string) pathResolver {
+	if dir == "/" {
+		return resolve
+	}
+	return func(rel string) (string, error) {
+		if p := path.Join("/", rel); p != dir && !strings.HasPrefix(p, dir+"/") {
+			return "", errOutsideUploadDir
+		}
+		return resolve(rel)
+	}
+}
+
+// errManifestUpload is returned for writes onto a directory manifest, which
+// would otherwise let any uploader set response headers.
+var errManifestUpload = &statusError{http.StatusForbidden, "Directory manifests can't be uploaded"}
+
+// refuseManifest wraps resolve to fail with errManifestUpload for paths whose
+// base name is the manifest name. An empty name refuses nothing.
+func refuseManifest(resolve pathResolver, name string) pathResolver {
+	if name == "" {
+		return resolve
+	}
+	return func(rel string) (string, error) {
+		if strings.EqualFold(path.Base(path.Join("/", rel)), name) {
+			return "", errManifestUpload
+		}
+		return resolve(rel)
+	}
+}
+
+// resolvePath joins rel onto root and checks the result stays inside it.
+// With followSymlinks, symlinks along the existing part of the path are
+// resolved too, so a link pointing outside root is refused; root must then
+// be canonical.
+func resolvePath(root, rel string, followSymlinks bool) (string, error) {
+	p := filepath.Join(root, filepath.FromSlash(rel))
+	if !withinRoot(root, p) {
+		return "", errEscapesRoot
+	}
+	if !followSymlinks {
+		return p, nil
+	}
+
+	// Whatever doesn't exist yet can't be a symlink, so only the longest
+	// existing prefix needs resolving
+	existing, rest := p, ""
+	for {
+		resolved, err := filepath.EvalSymlinks(existing)
+		if err == nil {
+			p = filepath.Join(resolved, rest)
+			if !withinRoot(root, p) {
+				return "", errEscapesRoot
+			}
+			return p, nil
+		}
+		parent := filepath.Dir(existing)
+		if !os.IsNotExist(err) || parent == existing {
+			return "", &statusError{http.StatusNotFound, "File or directory not found"}
+		}
+		rest = filepath.Join(filepath.Base(existing), rest)
+		existing = parent
+	}
+}
+
+// resolveEntry resolves the directory containing rel but not rel itself, so
+// deletes and renames act on a symlink rather than on its target.
+func resolveEntry(resolve pathResolver, rel string) (string, error) {
+	dir, err := resolve(filepath.Dir(filepath.FromSlash(rel)))
+	if err != nil {
+		return "", err
+	}
+	// gopi's own directories and manifests are off limits even though their
+	// parent isn't
+	if _, err := resolve(rel); err == errInternalPath || err == errManifestUpload {
+		return "", err
+	}
+	return filepath.Join(dir, filepath.Base(filepath.FromSlash(rel))), nil
+}
+
+// isRootPath reports whether rel names the root itself.
+func isRootPath(rel string) bool {
+	return path.Clean("/"+rel) == "/"
+}
+
+// withinRoot reports whether p is root or lies beneath it.
+func withinRoot(root, p string) bool {
+	rel, err := filepath.Rel(root, p)
+	return err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
+
+// htpasswd maps user names to password hashes as found in an htpasswd file.
+type htpasswd map[string]string
+
+// loadHtpasswd reads "user:hash" lines. Supported hashes are {SHA} (as made
+// by htpasswd -s) and plain text; other schemes are rejected up front rather
+// than failing every login.
+func loadHtpasswd(file string) (htpasswd, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	users := htpasswd{}
+	scanner := bufio.NewScanner(f)
+	for lineNo := 1; scanner.Scan(); lineNo++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		name, hash, ok := strings.Cut(line, ":")
+		if !ok || name == "" {
+			return nil, fmt.Errorf("line %d: expected user:hash", lineNo)
+		}
+		// Names double as home directory names
+		if name == "." || name == ".." || strings.ContainsAny(name, `/\`) {
+			return nil, fmt.Errorf("line %d: invalid user name %q", lineNo, name)
+		}
+		if strings.HasPrefix(hash, "$") {
+			return nil, fmt.Errorf("line %d: unsupported hash scheme for %s", lineNo, name)
+		}
+		users[name] = hash
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return users, nil
+}
+
+func (h htpasswd) check(name, password string) bool {
+	hash, ok := h[name]
+	if !ok {
+		return false
+	}
+	candidate := password
+	if strings.HasPrefix(hash, "{SHA}") {
+		sum := sha1.Sum([]byte(password))
+		candidate = "{SHA}" + base64.StdEncoding.EncodeToString(sum[:])
+	}
+	return subtle.ConstantTimeCompare([]byte(hash), []byte(candidate)) == 1
+}
+
+type contextKey int
+
+const userKey contextKey = iota
+
+// requestUser returns the authenticated user name, or "" without auth.
+func requestUser(r *http.Request) string {
+	name, _ := r.Context().Value(userKey).(string)
+	return name
+}
+
+// homeName returns the directory under the prefix that r is scoped to: the
+// user's home in -user-homes mode, otherwise "".
+func homeName(r *http.Request, userHomes bool) string {
+	if !userHomes {
+		return ""
+	}
+	return requestUser(r)
+}
+
+// withBasicAuth requires valid credentials on every route except the health
+// checks and robots.txt. A nil user list disables authentication.
+func withBasicAuth(next http.Handler, users htpasswd) http.Handler {
+	if users == nil {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/readyz" || r.URL.Path == "/livez" || r.URL.Path == "/robots.txt" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		name, password, ok := r.BasicAuth()
+		if !ok || !users.check(name, password) {
+			w.Header().Set("WWW-Authenticate", `Basic realm="gopi", charset="UTF-8"`)
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), userKey, name)))
+	})
+}
+
+// withIPAllowList refuses clients outside reads for GET, HEAD and OPTIONS
+// and outside writes for every other method with 403, so downloads can be
+// public while uploads are limited to trusted networks. Health probes are
+// always let through.
+func withIPAllowList(next http.Handler, reads, writes cidrList) http.Handler {
+	if len(reads) == 0 && len(writes) == 0 {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/readyz" || r.URL.Path == "/livez" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		allowed := writes
+		switch r.Method {
+		case http.MethodGet, http.MethodHead, http.MethodOptions:
+			allowed = reads
+		}
+		if !allowed.allows(clientIP(r)) {
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// methodOverrideFormMax is the largest URL-encoded body searched for a
+// _method field. Anything bigger is an upload, not a form standing in for
+// a DELETE.
+const methodOverrideFormMax = 4 << 10
+
+// withMethodOverride treats a POST carrying X-HTTP-Method-Override: PUT or
+// DELETE, or a small URL-encoded form with _method=DELETE, as that method.
+// The body read while looking for the field is put back, but it is form
+// data, so the field can't ask for PUT. Any site can make a browser submit
+// a form, so the field is only honoured when sameOrigin vouches for the
+// request; the header can't be sent cross-site without a CORS preflight,
+// which gopi never grants. Only POST can be overridden, so a plain link or
+// image can never delete anything.
+func withMethodOverride(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			next.ServeHTTP(w, r)
+			return
+		}
+		r = r.WithContext(r.Context())
+		method := r.Header.Get("X-HTTP-Method-Override")
+		fromForm := false
+		if mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type")); method == "" && mediaType == "application/x-www-form-urlencoded" {
+			head, _ := io.ReadAll(io.LimitReader(r.Body, methodOverrideFormMax+1))
+			r.Body = struct {
+				io.Reader
+				io.Closer
+			}{io.MultiReader(bytes.NewReader(head), r.Body), r.Body}
+			if len(head) <= methodOverrideFormMax {
+				if form, err := url.ParseQuery(string(head)); err == nil {
+					method, fromForm = form.Get("_method"), true
+				}
+			}
+		}
+		if method == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if fromForm && !sameOrigin(r) {
+			http.Error(w, "Form method overrides are only accepted from the same origin", http.StatusForbidden)
+			return
+		}
+		switch method = strings.ToUpper(method); {
+		case method == http.MethodDelete, method == http.MethodPut && !fromForm:
+		default:
+			http.Error(w, "Unsupported method override", http.StatusBadRequest)
+			return
+		}
+		r.Method = method
+		r.Header = r.Header.Clone()
+		r.Header.Del("X-HTTP-Method-Override")
+		next.ServeHTTP(w, r)
+	})
+}
+
+// sameOrigin reports whether a browser says r came from a page on this
+// server, going by Sec-Fetch-Site or else Origin. Requests carrying
+// neither can't be vouched for.
+func sameOrigin(r *http.Request) bool {
+	if site := r.Header.Get("Sec-Fetch-Site"); site != "" {
+		return site == "same-origin"
+	}
+	origin, err := url.Parse(r.Header.Get("Origin"))
+	return err == nil && origin.Host != "" && origin.Host == r.Host
+}
+
+// retryAfterSeconds formats d for a Retry-After header, rounding up so
+// clients never come back before the wait is over.
+func retryAfterSeconds(d time.Duration) string {
+	return strconv.Itoa(int(math.Ceil(d.Seconds())))
+}
+
+// withMaintenance answers every content route with 503 while on is set,
+// leaving the health checks untouched.
+func withMaintenance(next http.Handler, on *atomic.Bool, message string, retryAfter time.Duration) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if on.Load() && r.URL.Path != "/readyz" && r.URL.Path != "/livez" {
+			w.Header().Set("Retry-After", retryAfterSeconds(retryAfter))
+			http.Error(w, message, http.StatusServiceUnavailable)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// withFallback answers everything but the health checks with page and
+// 503 while down is set, instead of letting requests fail one by one
+// against unavailable storage.
+func withFallback(next http.Handler, down *atomic.Bool, page []byte, retryAfter time.Duration) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if down.Load() && r.URL.Path != "/readyz" && r.URL.Path != "/livez" {
+			w.Header().Set("Retry-After", retryAfterSeconds(retryAfter))
+			w.Header().Set("Cache-Control", "no-store")
+			w.Header().Set("Content-Type", "text/html; charset=utf-8")
+			w.WriteHeader(http.StatusServiceUnavailable)
+			_, _ = w.Write(page)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// monitorPrefix checks every interval that the prefix can be read, as the
+// liveness probe does, and keeps down in step. A check still hanging after
+// an interval, as on a dead network mount, counts as a failure. It returns
+// once stop is closed.
+func monitorPrefix(dirPrefix string, interval time.Duration, down *atomic.Bool, stop <-chan struct{}) {
+	for {
+		result := make(chan error, 1)
+		go func() {
+			_, err := os.ReadDir(dirPrefix)
+			result <- err
+		}()
+		var err error
+		timedOut := false
+		select {
+		case err = <-result:
+		case <-time.After(interval):
+			err, timedOut = errors.New("timed out reading prefix"), true
+		}
+		if failed := err != nil; failed != down.Load() {
+			down.Store(failed)
+			if failed {
+				log.Printf("Prefix unavailable, serving fallback page: %v\n", err)
+			} else {
+				log.Println("Prefix available again")
+			}
+		}
+		if timedOut {
+			// Don't pile up checks behind one that is stuck
+			select {
+			case <-result:
+			case <-stop:
+				return
+			}
+		}
+		select {
+		case <-time.After(interval):
+		case <-stop:
+			return
+		}
+	}
+}
+
+// healthStatus is the JSON body of a health check response.
+type healthStatus struct {
+	Status string `json:"status"`
+	Check  string `json:"check,omitempty"`
+	Error  string `json:"error,omitempty"`
+}
+
+// writeHealth answers a health check with status: "ok" when it passed and
+// msg otherwise, or a healthStatus naming the failed check for clients
+// that want JSON. As with writeError, the cause is only included with
+// -verbose-errors.
+func writeHealth(w http.ResponseWriter, r *http.Request, status int, check, msg string, cause error) {
+	if verboseErrors && cause != nil {
+		msg += ": " + cause.Error()
+	}
+	if wantsJSON(r) {
+		body := healthStatus{Status: "ok"}
+		if status != http.StatusOK {
+			body = healthStatus{Status: "unhealthy", Check: check, Error: msg}
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(status)
+		_ = json.NewEncoder(w).Encode(body)
+		return
+	}
+	if status != http.StatusOK {
+		http.Error(w, msg, status)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	_, _ = w.Write([]byte("ok"))
+}
+
+// waitForPrefix polls until the prefix directory can be read and then marks
+// the server ready.
+func waitForPrefix(dirPrefix string, ready *atomic.Bool) {
+	for {
+		_, err := os.ReadDir(dirPrefix)
+		if err == nil {
+			ready.Store(true)
+			log.Println("Server is ready")
+			return
+		}
+		log.Printf("Waiting for prefix directory: %v\n", err)
+		time.Sleep(time.Second)
+	}
+}
+
+// ignoreSet hides paths matched by ignore files. Each directory under the
+// root may contain an ignore file with one glob per line; a pattern without
+// a slash matches names at any depth below that directory, one with a slash
+// matches the path relative to it. Parsed files are cached by mtime.
+type ignoreSet struct {
+	root string
+	name string
+
+	mu    sync.Mutex
+	cache map[string]ignoreFileCache
+}
+
+type ignoreFileCache struct {
+	modTime  time.Time
+	patterns []string
+}
+
+func newIgnoreSet(root, name string) *ignoreSet {
+	return &ignoreSet{root: filepath.Clean(root), name: name, cache: map[string]ignoreFileCache{}}
+}
+
+// hidden reports whether the filesystem path p, or any directory above it,
+// is matched by an ignore file. A nil set hides nothing.
+func (s *ignoreSet) hidden(p string) bool {
+	if s == nil {
+		return false
+	}
+	rel, err := filepath.Rel(s.root, p)
+	if err != nil || rel == "." || strings.HasPrefix(rel, "..") {
+		return false
+	}
+	parts := strings.Split(filepath.ToSlash(rel), "/")
+	if parts[len(parts)-1] == s.name {
+		return true
+	}
+
+	// Ancestor directory i applies its patterns to every path below it
+	for i := range parts {
+		patterns := s.patterns(filepath.Join(s.root, filepath.Join(parts[:i]...)))
+		for j := i; j < len(parts); j++ {
+			sub := strings.Join(parts[i:j+1], "/")
+			for _, pattern := range patterns {
+				target := sub
+				if !strings.Contains(pattern, "/") {
+					target = parts[j]
+				}
+				if ok, _ := path.Match(strings.TrimPrefix(pattern, "/"), target); ok {
+					return true
+				}
+			}
+		}
+	}
+	return false
+}
+
+// patterns returns the parsed ignore file in dir, if any.
+func (s *ignoreSet) patterns(dir string) []string {
+	file := filepath.Join(dir, s.name)
+	info, err := os.Stat(file)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err != nil {
+		delete(s.cache, dir)
+		return nil
+	}
+	if cached, ok := s.cache[dir]; ok && cached.modTime.Equal(info.ModTime()) {
+		return cached.patterns
+	}
+
+	data, err := os.ReadFile(file)
+	if err != nil {
+		log.Printf("Error reading ignore file %s: %v\n", file, err)
+		return nil
+	}
+	var patterns []string
+	for _, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		patterns = append(patterns, strings.TrimSuffix(line, "/"))
+	}
+	s.cache[dir] = ignoreFileCache{modTime: info.ModTime(), patterns: patterns}
+	return patterns
+}
+
+// dirManifests applies headers from per-directory manifest files such as
+// {"headers": {"Cache-Control": "no-store"}}. A file gets the headers of the
+// nearest manifest at or above its directory. Parsed manifests are cached by
+// mtime; malformed ones are logged and skipped, as are headers outside
+// manifestHeaders.
+type dirManifests struct {
+	root string
+	name string
+
+	mu    sync.Mutex
+	cache map[string]dirManifestCache
+}
+
+type dirManifestCache struct {
+	modTime time.Time
+	headers map[string]string
+	valid   bool
+}
+
+type dirManifest struct {
+	Headers map[string]string `json:"headers"`
+}
+
+// manifestHeaders lists the headers a manifest may set. Content-Type and the
+// security headers stay under the server's control.
+var manifestHeaders = map[string]bool{
+	"Cache-Control":       true,
+	"Content-Disposition": true,
+	"Content-Language":    true,
+	"Expires":             true,
+	"X-Robots-Tag":        true,
+}
+
+func newDirManifests(root, name string) *dirManifests {
+	return &dirManifests{root: filepath.Clean(root), name: name, cache: map[string]dirManifestCache{}}
+}
+
+// headers returns the headers for the file at p. A nil set has none.
+func (m *dirManifests) headers(p string) map[string]string {
+	if m == nil {
+		return nil
+	}
+	for dir := filepath.Dir(p); withinRoot(m.root, dir); dir = filepath.Dir(dir) {
+		if headers, ok := m.load(dir); ok {
+			return headers
+		}
+		if dir == m.root {
+			break
+		}
+	}
+	return nil
+}
+
+// load returns the parsed manifest in dir, if there is a valid one.
+func (m *dirManifests) load(dir string) (map[string]string, bool) {
+	file := filepath.Join(dir, m.name)
+	info, err := os.Stat(file)
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if err != nil {
+		delete(m.cache, dir)
+		return nil, false
+	}
+	if cached, ok := m.cache[dir]; ok && cached.modTime.Equal(info.ModTime()) {
+		return cached.headers, cached.valid
+	}
+
+	var manifest dirManifest
+	data, err := os.ReadFile(file)
+	if err == nil {
+		err = json.Unmarshal(data, &manifest)
+	}
+	if err != nil {
+		log.Printf("Warning: ignoring manifest %s: %v\n", file, err)
+	}
+	for key := range manifest.Headers {
+		if !manifestHeaders[http.CanonicalHeaderKey(key)] {
+			log.Printf("Warning: manifest %s may not set %s\n", file, key)
+			delete(manifest.Headers, key)
+		}
+	}
+	m.cache[dir] = dirManifestCache{modTime: info.ModTime(), headers: manifest.Headers, valid: err == nil}
+	return manifest.Headers, err == nil
+}
+
+// htmlListing holds what the HTML directory page needs.
+type htmlListing struct {
+	// Title is the URL path the page is for, never a filesystem path
+	Title     string
+	BasePath  string
+	URLPath   string
+	Entries   []listingEntry
+	Grouped   bool
+	Truncated bool
+	Total     int
+	// NextCursor is set on cursor pages that have more entries after them
+	NextCursor string
+	// Type is the ?type filter, carried over to the next page
+	Type string
+	// Recursive marks a flattened listing of the whole subtree
+	Recursive bool
+	// Partial is set when the directory read timed out part way
+	Partial bool
+	// Mobile selects the touch-friendly layout
+	Mobile bool
+	// Icons shows each entry's type icon
+	Icons bool
+}
+
+// htmlListingEntry renders the list item for entry in an HTML listing of
+// the directory at dir.
+func htmlListingEntry(basePath, dir string, icons bool, entry listingEntry) string {
+	name := entry.Name
+	if entry.IsDir {
+		name += "/"
+	}
+	icon := ""
+	if icons {
+		icon = fmt.Sprintf(`<svg width="16" height="16" aria-hidden="true"><use href="#icon-%s"/></svg> `, entryIcon(entry))
+	}
+	return fmt.Sprintf("      <li>%s<a href=\"%s\">%s</a></li>\n", icon, html.EscapeString(entryHref(basePath, dir, name)), html.EscapeString(name))
+}
+
+// jsonEntrySize is how many bytes entry takes up in a JSON listing.
+func jsonEntrySize(entry listingEntry) int {
+	b, _ := json.Marshal(entry)
+	return len(b) + 1
+}
+
+// plainEntrySize is how many bytes entry takes up in a plain text listing.
+func plainEntrySize(entry listingEntry) int {
+	if entry.IsDir {
+		return len(entry.Name) + 2
+	}
+	return len(entry.Name) + 1
+}
+
+// fitListingBytes keeps the leading entries that together cost at most
+// budget bytes, and reports whether any had to go. The first entry is
+// always kept so a paged client can make progress.
+func fitListingBytes(entries []listingEntry, budget int64, cost func(listingEntry) int) ([]listingEntry, bool) {
+	var used int64
+	for i, entry := range entries {
+		if used += int64(cost(entry)); used > budget && i > 0 {
+			return entries[:i], true
+		}
+	}
+	return entries, false
+}
+
+// listingIconSprite defines the type icons once per page; entries refer to
+// them with <use>, so no extra requests or styles are needed.
+const listingIconSprite = `  <svg xmlns="http://www.w3.org/2000/svg" width="0" height="0" aria-hidden="true">
+    <symbol id="icon-folder" viewBox="0 0 16 16"><path fill="#d9a520" d="M1 3h5l2 2h7v8H1z"/></symbol>
+    <symbol id="icon-text" viewBox="0 0 16 16"><path fill="#fff" stroke="#666" d="M3.5 1.5h6l3 3v10h-9z"/><path stroke="#666" d="M5 7h6M5 9h6M5 11h4"/></symbol>
+    <symbol id="icon-image" viewBox="0 0 16 16"><path fill="#fff" stroke="#666" d="M1.5 2.5h13v11h-13z"/><path fill="#4a9" d="M2 13l4-5 3 3 2-2 3 4z"/><circle fill="#e94" cx="11" cy="5.5" r="1.5"/></symbol>
+    <symbol id="icon-archive" viewBox="0 0 16 16"><path fill="#c96" stroke="#864" d="M2.5 1.5h11v13h-11z"/><path stroke="#864" d="M8 2v2m0 1v2m0 1v2"/><path fill="#864" d="M7 10h2v3H7z"/></symbol>
+    <symbol id="icon-file" viewBox="0 0 16 16"><path fill="#fff" stroke="#666" d="M3.5 1.5h6l3 3v10h-9z"/><path fill="none" stroke="#666" d="M9.5 1.5v3h3"/></symbol>
+  </svg>
+`
+
+// archiveExts are the archive and package extensions given the archive
+// icon, beyond what the MIME table says.
+var archiveExts = map[string]bool{
+	".zip": true, ".tar": true, ".gz": true, ".tgz": true, ".bz2": true, ".xz": true,
+	".zst": true, ".7z": true, ".rar": true, ".whl": true, ".egg": true, ".jar": true,
+}
+
+// textExts are the text formats given the text icon that the MIME table
+// doesn't file under text/.
+var textExts = map[string]bool{
+	".json": true, ".md": true, ".yaml": true, ".yml": true, ".toml": true, ".ini": true,
+	".cfg": true, ".log": true, ".txt": true, ".py": true, ".go": true, ".sh": true,
+}
+
+// entryIcon names the icon for entry, falling back to a generic file.
+func entryIcon(entry listingEntry) string {
+	if entry.IsDir {
+		return "folder"
+	}
+	ext := strings.ToLower(filepath.Ext(entry.Name))
+	ctype := mime.TypeByExtension(ext)
+	switch {
+	case archiveExts[ext], strings.Contains(ctype, "zip"), strings.Contains(ctype, "compressed"):
+		return "archive"
+	case strings.HasPrefix(ctype, "image/"):
+		return "image"
+	case textExts[ext], strings.HasPrefix(ctype, "text/"):
+		return "text"
+	}
+	return "file"
+}
+
+// mobileListingStyle gives each entry a full-width, finger-sized target.
+const mobileListingStyle = `  <style>
+    body { margin: 0; font: 18px/1.4 sans-serif; }
+    h1 { font-size: 1.2em; padding: 0 12px; word-break: break-all; }
+    h2 { font-size: 1em; padding: 0 12px; }
+    ul { list-style: none; margin: 0; padding: 0; }
+    li a { display: block; padding: 14px 12px; border-bottom: 1px solid #ddd; text-decoration: none; word-break: break-all; }
+    p { padding: 0 12px; }
+  </style>
+`
+
+// isMobile reports whether the User-Agent looks like a phone or tablet
+// browser. Anything unrecognised gets the desktop page.
+func isMobile(r *http.Request) bool {
+	ua := r.Header.Get("User-Agent")
+	for _, marker := range []string{"Mobi", "Android", "iPhone", "iPad", "iPod"} {
+		if strings.Contains(ua, marker) {
+			return true
+		}
+	}
+	return false
+}
+
+// writeHTMLListing renders a directory page. Grouped listings put
+// directories and files in separate sections; entries must already be
+// sorted accordingly.
+func writeHTMLListing(w io.Writer, page htmlListing) {
+	writeEntries := func(entries []listingEntry) {
+		fmt.Fprintf(w, "    <ul>\n")
+		for _, entry := range entries {
+			_, _ = io.WriteString(w, htmlListingEntry(page.BasePath, page.URLPath, page.Icons, entry))
+		}
+		fmt.Fprintf(w, "    </ul>\n")
+	}
+
+	fmt.Fprintf(w, "<!DOCTYPE html>\n")
+	fmt.Fprintf(w, "<html lang=\"en\">\n")
+	fmt.Fprintf(w, "<head>\n")
+	fmt.Fprintf(w, "  <meta charset=\"utf-8\">\n")
+	fmt.Fprintf(w, "  <meta name=\"viewport\" content=\"width=device-width, initial-scale=1\">\n")
+	fmt.Fprintf(w, "  <title>Directory listing for %s</title>\n", html.EscapeString(page.Title))
+	if page.Mobile {
+		_, _ = io.WriteString(w, mobileListingStyle)
+	}
+	fmt.Fprintf(w, "</head>\n")
+	fmt.Fprintf(w, "<body>\n")
+	if page.Icons {
+		_, _ = io.WriteString(w, listingIconSprite)
+	}
+	fmt.Fprintf(w, "  <header>\n")
+	fmt.Fprintf(w, "    <h1>Links for %s</h1>\n", html.EscapeString(page.Title))
+	fmt.Fprintf(w, "  </header>\n")
+	fmt.Fprintf(w, "  <main>\n")
+	if page.Grouped {
+		split := 0
+		for split < len(page.Entries) && page.Entries[split].IsDir {
+			split++
+		}
+		if dirs := page.Entries[:split]; len(dirs) > 0 {
+			fmt.Fprintf(w, "    <h2>Directories</h2>\n")
+			writeEntries(dirs)
+		}
+		if files := page.Entries[split:]; len(files) > 0 {
+			fmt.Fprintf(w, "    <h2>Files</h2>\n")
+			writeEntries(files)
+		}
+	} else {
+		writeEntries(page.Entries)
+	}
+	if page.NextCursor != "" {
+		q := url.Values{"after": {page.NextCursor}, "limit": {strconv.Itoa(len(page.Entries))}}
+		if page.Type != "" {
+			q.Set("type", page.Type)
+		}
+		if page.Recursive {
+			q.Set("recursive", "1")
+		}
+		fmt.Fprintf(w, "    <p><a href=\"?%s\">Next page</a></p>\n", html.EscapeString(q.Encode()))
+	} else if page.Truncated {
+		fmt.Fprintf(w, "    <p>Showing first %d of %d entries</p>\n", len(page.Entries), page.Total)
+	}
+	if page.Partial {
+		fmt.Fprintf(w, "    <p>This listing is incomplete: the directory took too long to read. Reload to try again.</p>\n")
+	}
+	fmt.Fprintf(w, "  </main>\n")
+	fmt.Fprintf(w, "</body>\n")
+	fmt.Fprintf(w, "</html>\n")
+}
+
+// pageAfter sorts entries by name and returns up to limit of those named
+// after cursor (all of them when limit is 0), along with the cursor for the
+// following page, or "" on the last page.
+func pageAfter(entries []listingEntry, cursor string, limit int) ([]listingEntry, string) {
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Name < entries[j].Name })
+	start := sort.Search(len(entries), func(i int) bool { return entries[i].Name > cursor })
+	entries = entries[start:]
+	if limit == 0 || len(entries) <= limit {
+		return entries, ""
+	}
+	entries = entries[:limit]
+	return entries, entries[limit-1].Name
+}
+
+// sortListing orders entries by spec, one of "name", "modtime" or "size"
+// with an optional "-asc" or "-desc" suffix. Ties fall back to the name;
+// grouped keeps directories before files.
+func sortListing(entries []listingEntry, spec string, grouped bool) error {
+	key, desc := strings.CutSuffix(spec, "-desc")
+	key = strings.TrimSuffix(key, "-asc")
+	var compare func(a, b listingEntry) int
+	switch key {
+	case "name":
+		compare = func(a, b listingEntry) int { return strings.Compare(a.Name, b.Name) }
+	case "modtime":
+		compare = func(a, b listingEntry) int { return a.ModTime.Compare(b.ModTime) }
+	case "size":
+		compare = func(a, b listingEntry) int { return cmp.Compare(a.Size, b.Size) }
+	default:
+		return &statusError{http.StatusBadRequest, "Invalid sort order"}
+	}
+	sort.SliceStable(entries, func(i, j int) bool {
+		a, b := entries[i], entries[j]
+		if grouped && a.IsDir != b.IsDir {
+			return a.IsDir
+		}
+		c := compare(a, b)
+		if desc {
+			c = -c
+		}
+		if c == 0 {
+			c = strings.Compare(a.Name, b.Name)
+		}
+		return c < 0
+	})
+	return nil
+}
+
+// listing is the JSON representation of a directory.
+type listing struct {
+	Path       string         `json:"path"`
+	Entries    []listingEntry `json:"entries"`
+	Counts     entryCounts    `json:"counts"`
+	Truncated  bool           `json:"truncated"`
+	NextCursor string         `json:"next_cursor,omitempty"`
+	Partial    bool           `json:"partial,omitempty"`
+}
+
+// entryCounts tallies a directory's entries by kind.
+type entryCounts struct {
+	Total int `json:"total"`
+	Dirs  int `json:"dirs"`
+	Files int `json:"files"`
+}
+
+func countEntries(entries []listingEntry) entryCounts {
+	counts := entryCounts{Total: len(entries)}
+	for _, entry := range entries {
+		if entry.IsDir {
+			counts.Dirs++
+		}
+	}
+	counts.Files = counts.Total - counts.Dirs
+	return counts
+}
+
+type listingEntry struct {
+	Name    string    `json:"name"`
+	IsDir   bool      `json:"is_dir"`
+	Size    int64     `json:"size"`
+	ModTime time.Time `json:"mod_time"`
+	SHA256  string    `json:"sha256,omitempty"`
+}
+
+// fileStat is the ?stat=1 metadata of a file.
+type fileStat struct {
+	Name    string    `json:"name"`
+	Size    int64     `json:"size"`
+	ModTime time.Time `json:"mod_time"`
+	ETag    string    `json:"etag"`
+	SHA256  string    `json:"sha256,omitempty"`
+}
+
+// readDirBatch is how many entries readDirTimeout reads at a time.
+const readDirBatch = 256
+
+// readDirTimeout reads the entries of the open directory f, giving up after
+// timeout (0 for no limit) or when ctx ends. It then returns the entries
+// read so far along with the context error. A read stuck in the filesystem
+// can't be interrupted, so it is left to finish in the background.
+func readDirTimeout(ctx context.Context, f *os.File, timeout time.Duration) ([]os.DirEntry, error) {
+	if timeout <= 0 {
+		return f.ReadDir(-1)
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	batches := make(chan []os.DirEntry)
+	result := make(chan error, 1)
+	go func() {
+		for {
+			batch, err := f.ReadDir(readDirBatch)
+			if len(batch) > 0 {
+				select {
+				case batches <- batch:
+				case <-ctx.Done():
+					return
+				}
+			}
+			if err == io.EOF {
+				err = nil
+			}
+			if err != nil || len(batch) == 0 {
+				result <- err
+				return
+			}
+		}
+	}()
+	var files []os.DirEntry
+	for {
+		select {
+		case batch := <-batches:
+			files = append(files, batch...)
+		case err := <-result:
+			return files, err
+		case <-ctx.Done():
+			return files, ctx.Err()
+		}
+	}
+}
+
+// recursivePageSize is the page size of a ?recursive=1 listing when the
+// client doesn't ask for one.
+const recursivePageSize = 1000
+
+// recursiveEntries lists the files under root by their slash-separated
+// paths relative to it, for a flattened listing. Symlinks are listed but
+// not followed, so the walk stays within root; subtrees that can't be read
+// are skipped. It reports whether the walk was depth limited.
+func recursiveEntries(root string, walker treeWalker, keep func(os.DirEntry) bool) ([]listingEntry, bool) {
+	var entries []listingEntry
+	limited, _ := walker.walk(root, func(p string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() || !keep(d) {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return nil
+		}
+		rel, _ := filepath.Rel(root, p)
+		entries = append(entries, listingEntry{
+			Name:    filepath.ToSlash(rel),
+			Size:    info.Size(),
+			ModTime: info.ModTime(),
+		})
+		return nil
+	})
+	return entries, limited
+}
+
+// addSidecarChecksums fills in SHA256 for files in dir that have a .sha256
+// sidecar among the entries.
+func addSidecarChecksums(dir string, entries []listingEntry) {
+	names := make(map[string]bool, len(entries))
+	for _, entry := range entries {
+		names[entry.Name] = true
+	}
+	for i, entry := range entries {
+		if entry.IsDir || !names[entry.Name+".sha256"] {
+			continue
+		}
+		entries[i].SHA256, _ = sidecarChecksum(filepath.Join(dir, entry.Name))
+	}
+}
+
+// newListingEntries stats each directory entry. Entries that can no longer
+// be stat'ed are left out.
+func newListingEntries(files []os.DirEntry) []listingEntry {
+	entries := make([]listingEntry, 0, len(files))
+	for _, file := range files {
+		info, err := file.Info()
+		if err != nil {
+			continue
+		}
+		entries = append(entries, listingEntry{
+			Name:    file.Name(),
+			IsDir:   file.IsDir(),
+			Size:    info.Size(),
+			ModTime: info.ModTime(),
+		})
+	}
+	return entries
+}
+
+// filterType keeps only the directories, or only the files.
+func filterType(entries []listingEntry, dirs bool) []listingEntry {
+	kept := entries[:0]
+	for _, entry := range entries {
+		if entry.IsDir == dirs {
+			kept = append(kept, entry)
+		}
+	}
+	return kept
+}
+
+// filterModifiedSince keeps the entries modified at or after t.
+func filterModifiedSince(entries []listingEntry, t time.Time) []listingEntry {
+	kept := entries[:0]
+	for _, entry := range entries {
+		if !entry.ModTime.Before(t) {
+			kept = append(kept, entry)
+		}
+	}
+	return kept
+}
+
+type rssFeed struct {
+	XMLName xml.Name   `xml:"rss"`
+	Version string     `xml:"version,attr"`
+	Channel rssChannel `xml:"channel"`
+}
+
+type rssChannel struct {
+	Title       string    `xml:"title"`
+	Link        string    `xml:"link"`
+	Description string    `xml:"description"`
+	Items       []rssItem `xml:"item"`
+}
+
+type rssItem struct {
+	Title     string       `xml:"title"`
+	Link      string       `xml:"link"`
+	GUID      string       `xml:"guid"`
+	PubDate   string       `xml:"pubDate"`
+	Enclosure rssEnclosure `xml:"enclosure"`
+}
+
+type rssEnclosure struct {
+	URL    string `xml:"url,attr"`
+	Length int64  `xml:"length,attr"`
+	Type   string `xml:"type,attr"`
+}
+
+// writeRSS renders the files of a directory as an RSS 2.0 feed, newest
+// first, so a drop directory can be followed from a feed reader.
+func writeRSS(w http.ResponseWriter, r *http.Request, basePath string, entries []listingEntry) {
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+	origin := scheme + "://" + r.Host
+
+	var files []listingEntry
+	for _, entry := range entries {
+		if !entry.IsDir {
+			files = append(files, entry)
+		}
+	}
+	sort.SliceStable(files, func(i, j int) bool {
+		return files[i].ModTime.After(files[j].ModTime)
+	})
+
+	feed := rssFeed{
+		Version: "2.0",
+		Channel: rssChannel{
+			Title:       "Files in " + r.URL.Path,
+			Link:        origin + (&url.URL{Path: basePath + r.URL.Path}).String(),
+			Description: "Files published in " + r.URL.Path,
+		},
+	}
+	for _, file := range files {
+		link := origin + entryHref(basePath, r.URL.Path, file.Name)
+		feed.Channel.Items = append(feed.Channel.Items, rssItem{
+			Title:   file.Name,
+			Link:    link,
+			GUID:    link,
+			PubDate: file.ModTime.UTC().Format(time.RFC1123Z),
+			Enclosure: rssEnclosure{
+				URL:    link,
+				Length: file.Size,
+				Type:   "application/octet-stream",
+			},
+		})
+	}
+
+	w.Header().Set("Content-Type", "application/rss+xml; charset=utf-8")
+	_, _ = io.WriteString(w, xml.Header)
+	enc := xml.NewEncoder(w)
+	enc.Indent("", "  ")
+	if err := enc.Encode(feed); err != nil {
+		log.Printf("Error writing feed: %v\n", err)
+	}
+}
+
+// notModifiedSince reports whether r's If-Modified-Since covers modTime.
+func notModifiedSince(r *http.Request, modTime time.Time) bool {
+	since, err := http.ParseTime(r.Header.Get("If-Modified-Since"))
+	if err != nil {
+		return false
+	}
+	// HTTP dates have whole-second precision
+	return !modTime.Truncate(time.Second).After(since)
+}
+
+// wantsJSON reports whether the client asked for a JSON listing, either with
+// ?format=json or through the Accept header.
+func wantsJSON(r *http.Request) bool {
+	if format := r.URL.Query().Get("format"); format != "" {
+		return format == "json"
+	}
+	return strings.Contains(r.Header.Get("Accept"), "application/json")
+}
+
+// wantsPlain reports whether the client asked for a plain-text listing with
+// ?format=text or Accept: text/plain, or is curl or wget without asking for
+// HTML.
+func wantsPlain(r *http.Request) bool {
+	if format := r.URL.Query().Get("format"); format != "" {
+		return format == "text"
+	}
+	accept := r.Header.Get("Accept")
+	if strings.Contains(accept, "text/html") {
+		return false
+	}
+	if strings.Contains(accept, "text/plain") {
+		return true
+	}
+	ua := r.Header.Get("User-Agent")
+	return strings.HasPrefix(ua, "curl/") || strings.HasPrefix(ua, "Wget/")
+}
+
+// writePlainListing writes one entry name per line, with a trailing slash
+// on directories.
+func writePlainListing(w io.Writer, entries []listingEntry) {
+	bw := bufio.NewWriter(w)
+	for _, entry := range entries {
+		bw.WriteString(entry.Name)
+		if entry.IsDir {
+			bw.WriteByte('/')
+		}
+		bw.WriteByte('\n')
+	}
+	_ = bw.Flush()
+}
+
+// buildCommit returns the commit set at link time, falling back to the VCS
+// revision the Go toolchain stamps into the binary.
+func buildCommit() string {
+	if commit != "" {
+		return commit
+	}
+	if info, ok := debug.ReadBuildInfo(); ok {
+		for _, setting := range info.Settings {
+			if setting.Key == "vcs.revision" {
+				return setting.Value
+			}
+		}
+	}
+	return "unknown"
+}
+
+// splitList splits a comma-separated flag value, dropping empty items.
+func splitList(s string) []string {
+	var items []string
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// filterTempFiles drops entries that look like in-progress uploads: names
+// matching one of the temp patterns and zero-byte regular files.
+func filterTempFiles(files []os.DirEntry, patterns []string) []os.DirEntry {
+	kept := files[:0]
+	for _, file := range files {
+		if isTempFile(file, patterns) {
+			continue
+		}
+		kept = append(kept, file)
+	}
+	return kept
+}
+
+func isTempFile(file os.DirEntry, patterns []string) bool {
+	for _, pattern := range patterns {
+		if ok, _ := filepath.Match(pattern, file.Name()); ok {
+			return true
+		}
+	}
+	if file.Type().IsRegular() {
+		if info, err := file.Info(); err == nil && info.Size() == 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// textCharset returns ctype with charset appended if it is a text/* type
+// without one, or "" when ctype should be left to http.ServeFile.
+func textCharset(ctype, charset string) string {
+	if charset == "" || !strings.HasPrefix(ctype, "text/") || strings.Contains(ctype, "charset=") {
+		return ""
+	}
+	return ctype + "; charset=" + charset
+}
+
+// checksumHashes are the digests ?checksum can compute.
+var checksumHashes = map[string]func() hash.Hash{
+	"md5":    md5.New,
+	"sha1":   sha1.New,
+	"sha256": sha256.New,
+}
+
+// sidecarChecksum reads the digest from p's .sha256 sidecar, in either bare
+// or sha256sum format.
+func sidecarChecksum(p string) (string, bool) {
+	f, err := os.Open(p + ".sha256")
+	if err != nil {
+		return "", false
+	}
+	defer f.Close()
+	buf := make([]byte, 512)
+	n, _ := io.ReadFull(f, buf)
+	fields := strings.Fields(string(buf[:n]))
+	if len(fields) == 0 || len(fields[0]) != sha256.Size*2 {
+		return "", false
+	}
+	if _, err := hex.DecodeString(fields[0]); err != nil {
+		return "", false
+	}
+	return strings.ToLower(fields[0]), true
+}
+
+// checksumCache remembers digests until the file's size or modification
+// time changes.
+type checksumCache struct {
+	mu   sync.Mutex
+	sums map[string]cachedChecksum
+}
+
+type cachedChecksum struct {
+	modTime time.Time
+	size    int64
+	sum     string
+}
+
+// sum returns the hex digest of the file at p, hashing it only if no
+// digest is cached for its current version.
+func (c *checksumCache) sum(p, algo string, info os.FileInfo) (string, error) {
+	newHash, ok := checksumHashes[algo]
+	if !ok {
+		return "", &statusError{http.StatusBadRequest, "Unsupported checksum algorithm"}
+	}
+	if algo == "sha256" {
+		if sum, ok := sidecarChecksum(p); ok {
+			return sum, nil
+		}
+	}
+	key := algo + ":" + p
+	c.mu.Lock()
+	cached, ok := c.sums[key]
+	c.mu.Unlock()
+	if ok && cached.size == info.Size() && cached.modTime.Equal(info.ModTime()) {
+		return cached.sum, nil
+	}
+
+	f, err := os.Open(p)
+	if err != nil {
+		return "", &statusError{http.StatusNotFound, "File not found"}
+	}
+	defer f.Close()
+	h := newHash()
+	if _, err := io.Copy(h, f); err != nil {
+		log.Printf("Error hashing %s: %v\n", p, err)
+		return "", withDetail(&statusError{http.StatusInternalServerError, "Unable to compute checksum"}, err)
+	}
+	sum := hex.EncodeToString(h.Sum(nil))
+	c.mu.Lock()
+	c.sums[key] = cachedChecksum{modTime: info.ModTime(), size: info.Size(), sum: sum}
+	c.mu.Unlock()
+	return sum, nil
+}
+
+// tree returns a SHA-256 digest over the sorted relative path, size and
+// SHA-256 of every regular file under root, so identical trees hash alike
+// however they were written. The result is cached until the newest
+// modification time in the subtree or its number of entries changes,
+// which a new, removed or rewritten file always does. It also reports
+// whether the walk was depth limited.
+func (c *checksumCache) tree(root string, walker treeWalker) (string, bool, error) {
+	type treeFile struct {
+		rel  string
+		info os.FileInfo
+	}
+	var files []treeFile
+	var newest time.Time
+	entries := 0
+	limited, err := walker.walk(root, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		entries++
+		if info.ModTime().After(newest) {
+			newest = info.ModTime()
+		}
+		if d.Type().IsRegular() {
+			rel, _ := filepath.Rel(root, p)
+			files = append(files, treeFile{rel: filepath.ToSlash(rel), info: info})
+		}
+		return nil
+	})
+	if err != nil {
+		log.Printf("Error walking %s for tree checksum: %v\n", root, err)
+		return "", false, withDetail(&statusError{http.StatusInternalServerError, "Unable to compute checksum"}, err)
+	}
+
+	key := "tree:" + root
+	c.mu.Lock()
+	cached, ok := c.sums[key]
+	c.mu.Unlock()
+	if ok && cached.size == int64(entries) && cached.modTime.Equal(newest) {
+		return cached.sum, limited, nil
+	}
+
+	sort.Slice(files, func(i, j int) bool { return files[i].rel < files[j].rel })
+	h := sha256.New()
+	for _, file := range files {
+		sum, err := c.sum(filepath.Join(root, filepath.FromSlash(file.rel)), "sha256", file.info)
+		if err != nil {
+			return "", false, err
+		}
+		fmt.Fprintf(h, "%s\x00%d\x00%s\n", file.rel, file.info.Size(), sum)
+	}
+	sum := hex.EncodeToString(h.Sum(nil))
+	c.mu.Lock()
+	c.sums[key] = cachedChecksum{modTime: newest, size: int64(entries), sum: sum}
+	c.mu.Unlock()
+	return sum, limited, nil
+}
+
+// readCache keeps local copies of files served from a slow prefix, up to
+// limit bytes, evicting the least recently used. A copy is used only while
+// the source still has the size and modification time it was copied at.
+// A nil cache caches nothing.
+type readCache struct {
+	dir   string
+	limit int64
+
+	mu      sync.Mutex
+	entries map[string]*list.Element
+	lru     *list.List
+	size    int64
+}
+
+type readCacheEntry struct {
+	source  string
+	file    string
+	size    int64
+	modTime time.Time
+}
+
+// readCacheSuffix marks the cache's own files, which are cleared at
+// startup since nothing records what they were copied from.
+const readCacheSuffix = ".gopi-cache"
+
+func newReadCache(dir string, limit int64) (*readCache, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	stale, err := filepath.Glob(filepath.Join(dir, "*"+readCacheSuffix))
+	if err != nil {
+		return nil, err
+	}
+	for _, file := range stale {
+		os.Remove(file)
+	}
+	return &readCache{dir: dir, limit: limit, entries: make(map[string]*list.Element), lru: list.New()}, nil
+}
+
+// open returns the cached copy of source, whose open handle is src and
+// current stat info, copying it into the cache first on a miss when fill is
+// set. Requests reading little or nothing of the file, such as HEAD or a
+// Range, pass false rather than pay for a full copy. It returns nil, leaving
+// the caller to serve src, if the file isn't or can't be cached.
+func (c *readCache) open(source string, src *os.File, info os.FileInfo, fill bool) *os.File {
+	if c == nil || info.Size() > c.limit {
+		return nil
+	}
+	c.mu.Lock()
+	if el, ok := c.entries[source]; ok {
+		entry := el.Value.(*readCacheEntry)
+		if entry.size == info.Size() && entry.modTime.Equal(info.ModTime()) {
+			c.lru.MoveToFront(el)
+			c.mu.Unlock()
+			if f, err := os.Open(entry.file); err == nil {
+				return f
+			}
+			return nil
+		}
+	}
+	c.mu.Unlock()
+	if !fill {
+		return nil
+	}
+
+	sum := sha256.Sum256([]byte(source))
+	file := filepath.Join(c.dir, hex.EncodeToString(sum[:])+readCacheSuffix)
+	tmp, err := os.CreateTemp(c.dir, ".fill-*")
+	if err != nil {
+		log.Printf("Warning: unable to cache %s: %v\n", source, err)
+		return nil
+	}
+	_, err = io.Copy(tmp, io.NewSectionReader(src, 0, info.Size()))
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), file)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		log.Printf("Warning: unable to cache %s: %v\n", source, err)
+		return nil
+	}
+	f, err := os.Open(file)
+	if err != nil {
+		return nil
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if el, ok := c.entries[source]; ok {
+		c.size -= el.Value.(*readCacheEntry).size
+		c.lru.Remove(el)
+	}
+	c.entries[source] = c.lru.PushFront(&readCacheEntry{source: source, file: file, size: info.Size(), modTime: info.ModTime()})
+	c.size += info.Size()
+	for c.size > c.limit {
+		oldest := c.lru.Back().Value.(*readCacheEntry)
+		// Readers holding the file open keep their copy until they close it
+		os.Remove(oldest.file)
+		c.size -= oldest.size
+		c.lru.Remove(c.lru.Back())
+		delete(c.entries, oldest.source)
+	}
+	return f
+}
+
+// casDirName is the directory at the top of the prefix that holds the
+// content-addressable store.
+const casDirName = ".cas"
+
+// casEntry describes a logical file stored in the content-addressable store.
+type casEntry struct {
+	SHA256  string    `json:"sha256"`
+	Size    int64     `json:"size"`
+	ModTime time.Time `json:"mod_time"`
+}
+
+// casStore keeps uploaded files as blobs named by their SHA-256 digest, so
+// identical uploads share storage. A JSON manifest maps each logical
+// (uploaded) name to its blob.
+type casStore struct {
+	dir string
+
+	mu       sync.RWMutex
+	manifest map[string]casEntry
+}
+
+func openCASStore(dir string) (*casStore, error) {
+	for _, sub := range []string{"blobs", "tmp"} {
+		if err := os.MkdirAll(filepath.Join(dir, sub), 0755); err != nil {
+			return nil, err
+		}
+	}
+
+	s := &casStore{dir: dir, manifest: map[string]casEntry{}}
+	data, err := os.ReadFile(s.manifestPath())
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	if len(data) > 0 {
+		if err := json.Unmarshal(data, &s.manifest); err != nil {
+			return nil, fmt.Errorf("parsing manifest: %w", err)
+		}
+	}
+	return s, nil
+}
+
+// casKey normalizes a request or upload path into a manifest key.
+func casKey(p string) string {
+	return strings.TrimPrefix(path.Clean("/"+p), "/")
+}
+
+func (s *casStore) manifestPath() string {
+	return filepath.Join(s.dir, "manifest.json")
+}
+
+func (s *casStore) blobPath(sum string) string {
+	return filepath.Join(s.dir, "blobs", sum[:2], sum)
+}
+
+func (s *casStore) lookup(name string) (casEntry, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	entry, ok := s.manifest[name]
+	return entry, ok
+}
+
+func (s *casStore) names() []string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	names := make([]string, 0, len(s.manifest))
+	for name := range s.manifest {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// store copies src into the blob directory, hashing it on the way. If a blob
+// with the same digest already exists the new copy is discarded.
+func (s *casStore) store(src io.Reader) (casEntry, error) {
+	tmp, err := os.CreateTemp(filepath.Join(s.dir, "tmp"), "upload-*")
+	if err != nil {
+		return casEntry{}, err
+	}
+	defer os.Remove(tmp.Name())
+
+	hasher := sha256.New()
+	size, err := io.Copy(io.MultiWriter(tmp, hasher), src)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return casEntry{}, err
+	}
+
+	entry := casEntry{
+		SHA256:  hex.EncodeToString(hasher.Sum(nil)),
+		Size:    size,
+		ModTime: time.Now().UTC(),
+	}
+	blob := s.blobPath(entry.SHA256)
+	if _, err := os.Stat(blob); err == nil {
+		log.Printf("Deduplicated upload against blob %s\n", entry.SHA256)
+		return entry, nil
+	}
+	if err := os.MkdirAll(filepath.Dir(blob), 0755); err != nil {
+		return casEntry{}, err
+	}
+	if err := os.Chmod(tmp.Name(), 0444); err != nil {
+		return casEntry{}, err
+	}
+	return entry, os.Rename(tmp.Name(), blob)
+}
+
+// add records name in the manifest and persists it, refusing names
+// already taken. Checking and inserting under one lock means only one of
+// two uploads racing for a name can win.
+func (s *casStore) add(name string, entry casEntry) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.manifest[name]; ok {
+		return errCASNameTaken
+	}
+	s.manifest[name] = entry
+
+	data, err := json.MarshalIndent(s.manifest, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := s.manifestPath() + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, s.manifestPath())
+}
+
+// errCASNameTaken is returned for uploads to a logical name already in use.
+var errCASNameTaken = &statusError{http.StatusConflict, "File already exists"}
+
+// save stores src under the logical name, refusing names already taken.
+// Taken names are checked up front to avoid storing the upload for
+// nothing, and again when the name is recorded.
+func (s *casStore) save(src io.Reader, name string) error {
+	if _, ok := s.lookup(name); ok {
+		log.Printf("File already exists: %s\n", name)
+		return errCASNameTaken
+	}
+	entry, err := s.store(src)
+	if err == nil {
+		err = s.add(name, entry)
+	}
+	if err == errCASNameTaken {
+		log.Printf("File already exists: %s\n", name)
+		return err
+	}
+	if err != nil {
+		log.Printf("Error storing blob: %v\n", err)
+		return copyError(err)
+	}
+	log.Printf("File saved: %s (sha256 %s)\n", name, entry.SHA256)
+	return nil
+}
+
+// serve writes the blob behind entry, using the logical name for content
+// type detection.
+func (s *casStore) serve(w http.ResponseWriter, r *http.Request, entry casEntry) {
+	f, err := os.Open(s.blobPath(entry.SHA256))
+	if err != nil {
+		log.Printf("Error opening blob %s: %v\n", entry.SHA256, err)
+		http.Error(w, "File not found", http.StatusNotFound)
+		return
 	}
+	defer f.Close()
+	w.Header().Set("ETag", `"`+entry.SHA256+`"`)
+	serveContent(w, r, r.URL.Path, entry.ModTime, f)
 }
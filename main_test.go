@@ -0,0 +1,1703 @@
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"testing/iotest"
+	"time"
+)
+
+// newTestServer serves a fresh temporary prefix configured by args.
+func newTestServer(t *testing.T, args ...string) (*httptest.Server, string) {
+	t.Helper()
+	dir := t.TempDir()
+	return serveDir(t, dir, args...), dir
+}
+
+// serveDir serves dir configured by args until the test ends.
+func serveDir(t *testing.T, dir string, args ...string) *httptest.Server {
+	t.Helper()
+	flags := flag.NewFlagSet("gopi", flag.ContinueOnError)
+	a := setup(flags, append([]string{"-prefix", dir}, args...))
+	if a == nil {
+		t.Fatal("setup returned no server")
+	}
+	t.Cleanup(a.close)
+	srv := httptest.NewServer(a.handler)
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+// writeFile creates the file at name under dir, with its parents.
+func writeFile(t *testing.T, dir, name, content string) string {
+	t.Helper()
+	p := filepath.Join(dir, filepath.FromSlash(name))
+	if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(p, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return p
+}
+
+// fetch sends a request with the given "Key: Value" headers and returns
+// the response along with its body.
+func fetch(t *testing.T, method, url string, body io.Reader, headers ...string) (*http.Response, string) {
+	t.Helper()
+	req, err := http.NewRequest(method, url, body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, header := range headers {
+		key, value, _ := strings.Cut(header, ":")
+		req.Header.Set(key, strings.TrimSpace(value))
+	}
+	return send(t, http.DefaultClient, req)
+}
+
+// send sends req with client and reads the whole response body.
+func send(t *testing.T, client *http.Client, req *http.Request) (*http.Response, string) {
+	t.Helper()
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	b, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp, string(b)
+}
+
+// noRedirects is a client that hands redirects back instead of following.
+var noRedirects = &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error {
+	return http.ErrUseLastResponse
+}}
+
+func TestBasePath(t *testing.T) {
+	srv, dir := newTestServer(t, "-base-path", "/files")
+	writeFile(t, dir, "sub/a.txt", "hello")
+
+	resp, body := fetch(t, "GET", srv.URL+"/files/sub/", nil)
+	if resp.StatusCode != http.StatusOK || !strings.Contains(body, `href="/files/sub/a.txt"`) {
+		t.Fatalf("listing = %d %q, want links under /files", resp.StatusCode, body)
+	}
+	if _, body := fetch(t, "GET", srv.URL+"/files/sub/a.txt", nil); body != "hello" {
+		t.Errorf("file body = %q", body)
+	}
+
+	req, _ := http.NewRequest("GET", srv.URL+"/files/sub", nil)
+	resp, _ = send(t, noRedirects, req)
+	if loc := resp.Header.Get("Location"); resp.StatusCode != http.StatusMovedPermanently || loc != "/files/sub/" {
+		t.Errorf("redirect = %d %q, want 301 to /files/sub/", resp.StatusCode, loc)
+	}
+	req, _ = http.NewRequest("GET", srv.URL+"/files", nil)
+	if resp, _ = send(t, noRedirects, req); resp.Header.Get("Location") != "/files/" {
+		t.Errorf("mount point redirects to %q", resp.Header.Get("Location"))
+	}
+
+	if resp, _ := fetch(t, "GET", srv.URL+"/sub/a.txt", nil); resp.StatusCode != http.StatusNotFound {
+		t.Errorf("path outside base = %d, want 404", resp.StatusCode)
+	}
+	if resp, _ := fetch(t, "GET", srv.URL+"/livez", nil); resp.StatusCode != http.StatusOK {
+		t.Errorf("/livez outside base = %d, want 200", resp.StatusCode)
+	}
+}
+
+func TestAbortResumableUpload(t *testing.T) {
+	srv, dir := newTestServer(t)
+
+	resp, _ := fetch(t, "PUT", srv.URL+"/big.bin", strings.NewReader("01234"), "Content-Range: bytes 0-4/10")
+	if resp.StatusCode != http.StatusAccepted {
+		t.Fatalf("first chunk = %d, want 202", resp.StatusCode)
+	}
+	if _, body := fetch(t, "GET", srv.URL+"/", nil); strings.Contains(body, partsDirName) {
+		t.Errorf("listing shows the parts directory: %q", body)
+	}
+	if resp, _ := fetch(t, "GET", srv.URL+"/"+partsDirName+"/", nil); resp.StatusCode != http.StatusNotFound {
+		t.Errorf("GET of the parts directory = %d, want 404", resp.StatusCode)
+	}
+
+	if resp, _ := fetch(t, "DELETE", srv.URL+"/big.bin?action=abort", nil); resp.StatusCode != http.StatusOK {
+		t.Fatalf("abort = %d, want 200", resp.StatusCode)
+	}
+	resp, _ = fetch(t, "PUT", srv.URL+"/big.bin", strings.NewReader("56789"), "Content-Range: bytes 5-9/10")
+	if resp.StatusCode != http.StatusRequestedRangeNotSatisfiable || resp.Header.Get("X-Expected-Offset") != "0" {
+		t.Errorf("chunk after abort = %d offset %q, want 416 from 0", resp.StatusCode, resp.Header.Get("X-Expected-Offset"))
+	}
+	if resp, _ := fetch(t, "DELETE", srv.URL+"/big.bin?action=abort", nil); resp.StatusCode != http.StatusNotFound {
+		t.Errorf("second abort = %d, want 404", resp.StatusCode)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "big.bin")); !os.IsNotExist(err) {
+		t.Errorf("aborted upload was placed: %v", err)
+	}
+}
+
+func TestPartTTL(t *testing.T) {
+	srv, dir := newTestServer(t, "-part-ttl", "500ms")
+
+	// An ordinary file that merely looks like a partial upload
+	resp, _ := fetch(t, "PUT", srv.URL+"/backup/db.part", strings.NewReader("data"), "X-File-Mtime: 2020-01-01T00:00:00Z")
+	if resp.StatusCode != http.StatusCreated {
+		t.Fatalf("upload = %d", resp.StatusCode)
+	}
+	if resp, _ := fetch(t, "PUT", srv.URL+"/big.bin", strings.NewReader("01234"), "Content-Range: bytes 0-4/10"); resp.StatusCode != http.StatusAccepted {
+		t.Fatalf("chunk = %d", resp.StatusCode)
+	}
+	parts, _ := filepath.Glob(filepath.Join(dir, partsDirName, "*.part"))
+	if len(parts) != 1 {
+		t.Fatalf("parts = %v, want one", parts)
+	}
+	old := time.Now().Add(-time.Hour)
+	if err := os.Chtimes(parts[0], old, old); err != nil {
+		t.Fatal(err)
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		if _, err := os.Stat(parts[0]); os.IsNotExist(err) {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("stale part was never removed")
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	if _, body := fetch(t, "GET", srv.URL+"/backup/db.part", nil); body != "data" {
+		t.Errorf("user file = %q, want it kept", body)
+	}
+}
+
+func TestCASStoreIsHidden(t *testing.T) {
+	srv, _ := newTestServer(t, "-cas")
+	if resp, _ := fetch(t, "PUT", srv.URL+"/app/a.txt", strings.NewReader("hello")); resp.StatusCode != http.StatusCreated {
+		t.Fatalf("upload = %d", resp.StatusCode)
+	}
+
+	if _, body := fetch(t, "GET", srv.URL+"/", nil); strings.Contains(body, casDirName) {
+		t.Errorf("listing shows the store: %q", body)
+	}
+	for _, target := range []string{"/.cas/", "/.cas/manifest.json", "/app/../.cas/manifest.json"} {
+		if resp, _ := fetch(t, "GET", srv.URL+target, nil); resp.StatusCode != http.StatusNotFound {
+			t.Errorf("GET %s = %d, want 404", target, resp.StatusCode)
+		}
+	}
+	if resp, _ := fetch(t, "DELETE", srv.URL+"/.cas", nil); resp.StatusCode != http.StatusNotFound {
+		t.Errorf("DELETE /.cas = %d, want 404", resp.StatusCode)
+	}
+	if resp, _ := fetch(t, "PUT", srv.URL+"/.cas/blobs/x", strings.NewReader("x")); resp.StatusCode != http.StatusNotFound {
+		t.Errorf("PUT into the store = %d, want 404", resp.StatusCode)
+	}
+	if _, body := fetch(t, "GET", srv.URL+"/app/a.txt", nil); body != "hello" {
+		t.Errorf("logical name = %q after the attempts on the store", body)
+	}
+}
+
+func TestCASConcurrentSaveOneWins(t *testing.T) {
+	store, err := openCASStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	const uploads = 8
+	errs := make(chan error, uploads)
+	for i := range uploads {
+		go func() {
+			errs <- store.save(strings.NewReader(strings.Repeat("x", i+1)), "same.txt")
+		}()
+	}
+	won := 0
+	for range uploads {
+		switch err := <-errs; err {
+		case nil:
+			won++
+		case errCASNameTaken:
+		default:
+			t.Errorf("save: %v", err)
+		}
+	}
+	if won != 1 {
+		t.Errorf("%d uploads to one name succeeded, want 1", won)
+	}
+}
+
+func TestCASScreensLogicalNames(t *testing.T) {
+	srv, dir := newTestServer(t, "-cas", "-deny-serve-ext", ".env")
+	writeFile(t, dir, ".gopiignore", "*.secret\n")
+	for _, name := range []string{"/app/.env", "/app/key.secret", "/app/ok.txt"} {
+		if resp, _ := fetch(t, "PUT", srv.URL+name, strings.NewReader("SECRET=1")); resp.StatusCode != http.StatusCreated {
+			t.Fatalf("upload %s = %d", name, resp.StatusCode)
+		}
+	}
+
+	if resp, body := fetch(t, "GET", srv.URL+"/app/.env", nil); resp.StatusCode != http.StatusForbidden {
+		t.Errorf("denied extension = %d %q, want 403", resp.StatusCode, body)
+	}
+	if resp, _ := fetch(t, "GET", srv.URL+"/app/key.secret", nil); resp.StatusCode != http.StatusNotFound {
+		t.Errorf("ignored name = %d, want 404", resp.StatusCode)
+	}
+	if resp, _ := fetch(t, "GET", srv.URL+"/app/ok.txt", nil); resp.StatusCode != http.StatusOK {
+		t.Errorf("plain name = %d, want 200", resp.StatusCode)
+	}
+	if _, body := fetch(t, "GET", srv.URL+"/_cas", nil); strings.Contains(body, "key.secret") {
+		t.Errorf("/_cas lists an ignored name: %s", body)
+	}
+}
+
+func TestDenyServeExt(t *testing.T) {
+	srv, dir := newTestServer(t, "-deny-serve-ext", ".env")
+	writeFile(t, dir, "app/.env", "SECRET=1")
+	writeFile(t, dir, "app/prod.ENV", "SECRET=1")
+	writeFile(t, dir, "app/ok.txt", "fine")
+
+	for _, method := range []string{"GET", "HEAD"} {
+		for _, name := range []string{"/app/.env", "/app/prod.ENV"} {
+			if resp, body := fetch(t, method, srv.URL+name, nil); resp.StatusCode != http.StatusForbidden || strings.Contains(body, "SECRET") {
+				t.Errorf("%s %s = %d %q, want 403", method, name, resp.StatusCode, body)
+			}
+		}
+		if resp, _ := fetch(t, method, srv.URL+"/app/ok.txt", nil); resp.StatusCode != http.StatusOK {
+			t.Errorf("%s of an allowed extension = %d, want 200", method, resp.StatusCode)
+		}
+	}
+}
+
+func TestUploadDir(t *testing.T) {
+	srv, dir := newTestServer(t, "-upload-dir", "/drop")
+	writeFile(t, dir, "content/page.txt", "original")
+	writeFile(t, dir, "drop/.keep", "")
+
+	if resp, _ := fetch(t, "PUT", srv.URL+"/drop/ok.txt", strings.NewReader("ok")); resp.StatusCode != http.StatusCreated {
+		t.Errorf("upload inside -upload-dir = %d, want 201", resp.StatusCode)
+	}
+	if resp, _ := fetch(t, "PUT", srv.URL+"/content/evil.txt", strings.NewReader("evil")); resp.StatusCode != http.StatusForbidden {
+		t.Errorf("upload outside -upload-dir = %d, want 403", resp.StatusCode)
+	}
+	if resp, _ := fetch(t, "PUT", srv.URL+"/dropbox.txt", strings.NewReader("evil")); resp.StatusCode != http.StatusForbidden {
+		t.Errorf("upload to a sibling sharing the prefix = %d, want 403", resp.StatusCode)
+	}
+
+	moves := `[{"from": "/drop/ok.txt", "to": "/content/evil.txt"}, {"from": "/content/page.txt", "to": "/drop/page.txt"}, {"from": "/drop/ok.txt", "to": "/drop/moved.txt"}]`
+	_, body := fetch(t, "POST", srv.URL+"/?action=batch-move", strings.NewReader(moves), "Content-Type: application/json")
+	var results []batchResult
+	if err := json.Unmarshal([]byte(body), &results); err != nil || len(results) != 3 {
+		t.Fatalf("batch-move = %q", body)
+	}
+	if results[0].OK || results[1].OK || !results[2].OK {
+		t.Errorf("batch-move results = %+v, want only the move within -upload-dir to succeed", results)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "content", "evil.txt")); !os.IsNotExist(err) {
+		t.Errorf("a move wrote outside -upload-dir: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "content", "page.txt")); err != nil {
+		t.Errorf("a move took a file from outside -upload-dir: %v", err)
+	}
+}
+
+func TestManifestCannotBeUploaded(t *testing.T) {
+	srv, dir := newTestServer(t)
+	writeFile(t, dir, "a.txt", "a")
+
+	for _, name := range []string{"/.gopi.json", "/sub/.gopi.json", "/sub/.GOPI.JSON"} {
+		if resp, _ := fetch(t, "PUT", srv.URL+name, strings.NewReader(`{"headers": {}}`)); resp.StatusCode != http.StatusForbidden {
+			t.Errorf("PUT %s = %d, want 403", name, resp.StatusCode)
+		}
+	}
+	_, body := fetch(t, "POST", srv.URL+"/?action=batch-move", strings.NewReader(`[{"from": "/a.txt", "to": "/.gopi.json"}]`), "Content-Type: application/json")
+	var results []batchResult
+	if err := json.Unmarshal([]byte(body), &results); err != nil || len(results) != 1 || results[0].OK {
+		t.Errorf("batch-move onto the manifest = %q, want it refused", body)
+	}
+	if _, err := os.Stat(filepath.Join(dir, ".gopi.json")); !os.IsNotExist(err) {
+		t.Errorf("a manifest was written: %v", err)
+	}
+}
+
+func TestManifestHeaderAllowList(t *testing.T) {
+	srv, dir := newTestServer(t, "-secure-headers")
+	writeFile(t, dir, "a.txt", "a")
+	writeFile(t, dir, ".gopi.json", `{"headers": {
+		"cache-control": "no-store",
+		"Content-Type": "text/html",
+		"Content-Security-Policy": "default-src *",
+		"X-Content-Type-Options": "",
+		"Set-Cookie": "session=1"
+	}}`)
+
+	resp, _ := fetch(t, "GET", srv.URL+"/a.txt", nil)
+	if got := resp.Header.Get("Cache-Control"); got != "no-store" {
+		t.Errorf("Cache-Control = %q, want the manifest's no-store", got)
+	}
+	if got := resp.Header.Get("Content-Type"); !strings.HasPrefix(got, "text/plain") {
+		t.Errorf("Content-Type = %q, want text/plain", got)
+	}
+	if got := resp.Header.Get("Content-Security-Policy"); got == "default-src *" || got == "" {
+		t.Errorf("Content-Security-Policy = %q, want the server's", got)
+	}
+	if got := resp.Header.Get("X-Content-Type-Options"); got != "nosniff" {
+		t.Errorf("X-Content-Type-Options = %q, want nosniff", got)
+	}
+	if got := resp.Header.Get("Set-Cookie"); got != "" {
+		t.Errorf("Set-Cookie = %q, want none", got)
+	}
+}
+
+func TestListingEscapesNames(t *testing.T) {
+	srv, dir := newTestServer(t)
+	writeFile(t, dir, `<b>"x"&/<svg onload=alert(1)>.txt`, "x")
+
+	_, body := fetch(t, "GET", srv.URL+"/", nil)
+	if strings.Contains(body, "<b>") || !strings.Contains(body, ">&lt;b&gt;&#34;x&#34;&amp;/</a>") {
+		t.Errorf("directory name not escaped:\n%s", body)
+	}
+	resp, body := fetch(t, "GET", srv.URL+"/%3Cb%3E%22x%22&/", nil)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("subdirectory = %d", resp.StatusCode)
+	}
+	if strings.Contains(body, "<svg") || !strings.Contains(body, ">&lt;svg onload=alert(1)&gt;.txt</a>") {
+		t.Errorf("file name not escaped:\n%s", body)
+	}
+	if strings.Contains(body, "<b>") || !strings.Contains(body, "<h1>Links for /&lt;b&gt;&#34;x&#34;&amp;/</h1>") {
+		t.Errorf("heading not escaped:\n%s", body)
+	}
+	if strings.Contains(body, dir) {
+		t.Errorf("listing exposes the filesystem path %s:\n%s", dir, body)
+	}
+}
+
+func TestListingByteBudget(t *testing.T) {
+	const budget = 4096
+	srv, dir := newTestServer(t, "-max-listing-bytes", "4096")
+	for i := range 100 {
+		writeFile(t, dir, fmt.Sprintf("%03d-%s", i, strings.Repeat("n", 200)), "")
+	}
+
+	resp, body := fetch(t, "GET", srv.URL+"/", nil)
+	if resp.Header.Get("X-Listing-Truncated") != "true" {
+		t.Errorf("X-Listing-Truncated = %q, want true", resp.Header.Get("X-Listing-Truncated"))
+	}
+	var used, entries int
+	for _, line := range strings.SplitAfter(body, "\n") {
+		if strings.HasPrefix(line, "      <li>") {
+			used += len(line)
+			entries++
+		}
+	}
+	if entries == 0 || entries == 100 || used > budget {
+		t.Errorf("listing has %d entries in %d bytes, want some but not all within %d", entries, used, budget)
+	}
+}
+
+func TestConcurrentEditsOneWins(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		args []string
+	}{
+		{"plain", nil},
+		{"gzip", []string{"-gzip"}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			srv, dir := newTestServer(t, tc.args...)
+			writeFile(t, dir, "doc.txt", strings.Repeat("original ", 500))
+
+			resp, _ := fetch(t, "GET", srv.URL+"/doc.txt", nil, "Accept-Encoding: gzip")
+			etag := resp.Header.Get("ETag")
+			if strings.HasPrefix(etag, "W/") || etag == "" {
+				t.Fatalf("ETag = %q, want a strong validator", etag)
+			}
+			if tc.name == "gzip" && (resp.Header.Get("Content-Encoding") != "gzip" || !strings.HasSuffix(etag, `-gzip"`)) {
+				t.Fatalf("Content-Encoding = %q with ETag %q, want the compressed representation", resp.Header.Get("Content-Encoding"), etag)
+			}
+			if resp, _ := fetch(t, "GET", srv.URL+"/doc.txt", nil, "Accept-Encoding: gzip", "If-None-Match: "+etag); resp.StatusCode != http.StatusNotModified || resp.Header.Get("ETag") != etag {
+				t.Errorf("revalidation = %d with ETag %q, want 304 with %q", resp.StatusCode, resp.Header.Get("ETag"), etag)
+			}
+
+			statuses := make(chan int, 2)
+			for _, content := range []string{"first", "second"} {
+				go func() {
+					req, _ := http.NewRequest("PUT", srv.URL+"/doc.txt", strings.NewReader(content))
+					req.Header.Set("If-Match", etag)
+					req.Header.Set("Accept-Encoding", "gzip")
+					resp, err := http.DefaultClient.Do(req)
+					if err != nil {
+						statuses <- 0
+						return
+					}
+					resp.Body.Close()
+					statuses <- resp.StatusCode
+				}()
+			}
+			got := map[int]int{}
+			for range 2 {
+				got[<-statuses]++
+			}
+			if got[http.StatusOK] != 1 || got[http.StatusPreconditionFailed] != 1 {
+				t.Errorf("edit statuses = %v, want one 200 and one 412", got)
+			}
+
+			if resp, _ := fetch(t, "DELETE", srv.URL+"/doc.txt", nil, "If-Match: "+etag); resp.StatusCode != http.StatusPreconditionFailed {
+				t.Errorf("DELETE with a stale ETag = %d, want 412", resp.StatusCode)
+			}
+			resp, _ = fetch(t, "GET", srv.URL+"/doc.txt", nil, "Accept-Encoding: gzip")
+			if resp, _ := fetch(t, "DELETE", srv.URL+"/doc.txt", nil, "If-Match: "+resp.Header.Get("ETag")); resp.StatusCode != http.StatusOK {
+				t.Errorf("DELETE with the current ETag = %d, want 200", resp.StatusCode)
+			}
+		})
+	}
+}
+
+func TestMethodOverrideFormNeedsSameOrigin(t *testing.T) {
+	srv, dir := newTestServer(t, "-method-override")
+	writeFile(t, dir, "a.txt", "a")
+	form := "Content-Type: application/x-www-form-urlencoded"
+
+	for _, header := range []string{"Accept: */*", "Sec-Fetch-Site: cross-site", "Origin: http://evil.example", "Sec-Fetch-Site: same-site"} {
+		if resp, _ := fetch(t, "POST", srv.URL+"/a.txt", strings.NewReader("_method=DELETE"), form, header); resp.StatusCode != http.StatusForbidden {
+			t.Errorf("form override with %q = %d, want 403", header, resp.StatusCode)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(dir, "a.txt")); err != nil {
+		t.Fatalf("a cross-site form deleted the file: %v", err)
+	}
+
+	if resp, _ := fetch(t, "POST", srv.URL+"/a.txt", strings.NewReader("_method=DELETE"), form, "Origin: "+srv.URL); resp.StatusCode != http.StatusOK {
+		t.Errorf("same-origin form override = %d, want 200", resp.StatusCode)
+	}
+	writeFile(t, dir, "b.txt", "b")
+	if resp, _ := fetch(t, "POST", srv.URL+"/b.txt", strings.NewReader("_method=DELETE"), form, "Sec-Fetch-Site: same-origin"); resp.StatusCode != http.StatusOK {
+		t.Errorf("form override with Sec-Fetch-Site: same-origin = %d, want 200", resp.StatusCode)
+	}
+	writeFile(t, dir, "c.txt", "c")
+	if resp, _ := fetch(t, "POST", srv.URL+"/c.txt", nil, "X-HTTP-Method-Override: DELETE"); resp.StatusCode != http.StatusOK {
+		t.Errorf("header override = %d, want 200", resp.StatusCode)
+	}
+}
+
+func TestIPAllowListReadsButNotWrites(t *testing.T) {
+	srv, dir := newTestServer(t, "-upload-allow-cidr", "10.0.0.0/8")
+	writeFile(t, dir, "a.txt", "a")
+
+	if resp, _ := fetch(t, "GET", srv.URL+"/a.txt", nil); resp.StatusCode != http.StatusOK {
+		t.Errorf("GET from outside -upload-allow-cidr = %d, want 200", resp.StatusCode)
+	}
+	if resp, _ := fetch(t, "PUT", srv.URL+"/b.txt", strings.NewReader("b")); resp.StatusCode != http.StatusForbidden {
+		t.Errorf("PUT from outside -upload-allow-cidr = %d, want 403", resp.StatusCode)
+	}
+	if resp, _ := fetch(t, "DELETE", srv.URL+"/a.txt", nil); resp.StatusCode != http.StatusForbidden {
+		t.Errorf("DELETE from outside -upload-allow-cidr = %d, want 403", resp.StatusCode)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "b.txt")); !os.IsNotExist(err) {
+		t.Errorf("a refused upload was written: %v", err)
+	}
+
+	srv, _ = newTestServer(t, "-allow-cidr", "10.0.0.0/8")
+	if resp, _ := fetch(t, "GET", srv.URL+"/", nil); resp.StatusCode != http.StatusForbidden {
+		t.Errorf("GET from outside -allow-cidr = %d, want 403", resp.StatusCode)
+	}
+	if resp, _ := fetch(t, "GET", srv.URL+"/livez", nil); resp.StatusCode != http.StatusOK {
+		t.Errorf("/livez from outside -allow-cidr = %d, want 200", resp.StatusCode)
+	}
+}
+
+func TestETagStableAcrossInstances(t *testing.T) {
+	dir := t.TempDir()
+	writeFile(t, dir, "a.txt", "same bytes")
+	first, second := serveDir(t, dir), serveDir(t, dir)
+
+	resp1, _ := fetch(t, "GET", first.URL+"/a.txt", nil)
+	resp2, _ := fetch(t, "GET", second.URL+"/a.txt", nil)
+	etag := resp1.Header.Get("ETag")
+	if etag == "" || etag != resp2.Header.Get("ETag") {
+		t.Fatalf("ETags = %q and %q, want the same", etag, resp2.Header.Get("ETag"))
+	}
+	if resp, _ := fetch(t, "GET", second.URL+"/a.txt", nil, "If-None-Match: "+etag); resp.StatusCode != http.StatusNotModified {
+		t.Errorf("revalidating against the other instance = %d, want 304", resp.StatusCode)
+	}
+	if resp, body := fetch(t, "GET", second.URL+"/a.txt", nil, "Range: bytes=5-", "If-Range: "+etag); resp.StatusCode != http.StatusPartialContent || body != "bytes" {
+		t.Errorf("resuming on the other instance = %d %q, want 206 %q", resp.StatusCode, body, "bytes")
+	}
+}
+
+func TestEscapeAttempts(t *testing.T) {
+	outside := t.TempDir()
+	secret := writeFile(t, outside, "secret.txt", "TOPSECRET")
+	srv, dir := newTestServer(t, "-safe-mode")
+	writeFile(t, dir, "a.txt", "a")
+	if err := os.Symlink(outside, filepath.Join(dir, "link")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(secret, filepath.Join(dir, "linkfile")); err != nil {
+		t.Fatal(err)
+	}
+	up := "/../" + filepath.Base(outside)
+
+	for _, p := range []string{
+		up + "/secret.txt",
+		"/%2e%2e/" + filepath.Base(outside) + "/secret.txt",
+		"/..%2f" + filepath.Base(outside) + "%2fsecret.txt",
+		"/a.txt/../.." + up[3:] + "/secret.txt",
+		"/" + secret,
+		"/link/secret.txt",
+		"/linkfile",
+		"/link/",
+	} {
+		// Dot segments may be cleaned into a path inside the prefix, which
+		// doesn't exist there
+		if resp, body := fetch(t, "GET", srv.URL+p, nil); resp.StatusCode < 400 || strings.Contains(body, "TOPSECRET") {
+			t.Errorf("GET %s = %d %q, want it refused", p, resp.StatusCode, body)
+		}
+	}
+
+	for _, p := range []string{up + "/new.txt", "/%2e%2e/" + filepath.Base(outside) + "/new.txt"} {
+		fetch(t, "PUT", srv.URL+p, strings.NewReader("pwned"))
+		fetch(t, "PUT", srv.URL+p, strings.NewReader("pwned"), "Content-Range: bytes 0-4/10")
+	}
+	for _, p := range []string{"/link/new.txt", "/link/secret.txt", "/linkfile"} {
+		if resp, _ := fetch(t, "PUT", srv.URL+p, strings.NewReader("pwned")); resp.StatusCode < 300 {
+			t.Errorf("PUT %s = %d, want it refused", p, resp.StatusCode)
+		}
+		if resp, _ := fetch(t, "PUT", srv.URL+p, strings.NewReader("pwned"), "Content-Range: bytes 0-4/10"); resp.StatusCode < 300 {
+			t.Errorf("resumable PUT %s = %d, want it refused", p, resp.StatusCode)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(outside, "new.txt")); !os.IsNotExist(err) {
+		t.Errorf("an upload escaped the prefix: %v", err)
+	}
+
+	moves := `[{"from": "/a.txt", "to": "../` + filepath.Base(outside) + `/moved.txt"}, {"from": "/a.txt", "to": "/link/moved.txt"}, {"from": "../` + filepath.Base(outside) + `/secret.txt", "to": "/stolen.txt"}, {"from": "/link/secret.txt", "to": "/stolen.txt"}]`
+	_, body := fetch(t, "POST", srv.URL+"/?action=batch-move", strings.NewReader(moves), "Content-Type: application/json")
+	var results []batchResult
+	if err := json.Unmarshal([]byte(body), &results); err != nil || len(results) != 4 {
+		t.Fatalf("batch-move = %q", body)
+	}
+	for _, result := range results {
+		if result.OK {
+			t.Errorf("batch-move %s to %s succeeded, want it refused", result.Path, result.To)
+		}
+	}
+
+	deletes := `["../` + filepath.Base(outside) + `/secret.txt", "/link/secret.txt", "/link"]`
+	fetch(t, "POST", srv.URL+"/?action=batch-delete", strings.NewReader(deletes), "Content-Type: application/json")
+	for _, p := range []string{up + "/secret.txt", "/%2e%2e/" + filepath.Base(outside) + "/secret.txt", "/link/secret.txt"} {
+		if resp, _ := fetch(t, "DELETE", srv.URL+p, nil); resp.StatusCode < 300 {
+			t.Errorf("DELETE %s = %d, want it refused", p, resp.StatusCode)
+		}
+	}
+
+	if b, err := os.ReadFile(secret); err != nil || string(b) != "TOPSECRET" {
+		t.Errorf("file outside the prefix = %q, %v; want it untouched", b, err)
+	}
+	if entries, _ := os.ReadDir(outside); len(entries) != 1 {
+		t.Errorf("outside the prefix now holds %d entries, want only secret.txt", len(entries))
+	}
+}
+
+// writeTextTree fills dir with n compressible files of size bytes each,
+// spread over a few subdirectories.
+func writeTextTree(tb testing.TB, dir string, n, size int) int64 {
+	tb.Helper()
+	words := []string{"alpha ", "beta ", "gamma ", "delta ", "epsilon ", "zeta ", "eta ", "theta "}
+	var total int64
+	for i := range n {
+		var b strings.Builder
+		for seed := uint32(i); b.Len() < size; seed = seed*1103515245 + 12345 {
+			b.WriteString(words[seed>>16%uint32(len(words))])
+		}
+		p := filepath.Join(dir, fmt.Sprintf("d%d", i%4), fmt.Sprintf("f%03d.txt", i))
+		if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+			tb.Fatal(err)
+		}
+		if err := os.WriteFile(p, []byte(b.String()[:size]), 0644); err != nil {
+			tb.Fatal(err)
+		}
+		total += int64(size)
+	}
+	return total
+}
+
+func TestWriteZipParallelMatchesSequential(t *testing.T) {
+	dir := t.TempDir()
+	writeTextTree(t, dir, 40, 32<<10)
+	writeFile(t, dir, "big/large.txt", strings.Repeat("too big for a worker ", zipParallelMax/20))
+	writeFile(t, dir, "empty/.keep", "")
+	writeFile(t, dir, "naïve.txt", strings.Repeat("ünïcödé ", 100))
+
+	var sequential bytes.Buffer
+	if err := writeZip(&sequential, dir, 6, 1, treeWalker{}); err != nil {
+		t.Fatal(err)
+	}
+	for _, workers := range []int{2, 4, 16} {
+		var parallel bytes.Buffer
+		if err := writeZip(&parallel, dir, 6, workers, treeWalker{}); err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(parallel.Bytes(), sequential.Bytes()) {
+			t.Errorf("archive with %d workers differs from the sequential one", workers)
+		}
+	}
+
+	zr, err := zip.NewReader(bytes.NewReader(sequential.Bytes()), int64(sequential.Len()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, f := range zr.File {
+		if strings.HasSuffix(f.Name, "/") {
+			continue
+		}
+		info, err := os.Stat(filepath.Join(dir, filepath.FromSlash(f.Name)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !f.Modified.Equal(info.ModTime().Truncate(time.Second)) {
+			t.Errorf("entry %s modified %v, want %v", f.Name, f.Modified, info.ModTime())
+		}
+		rc, err := f.Open()
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := io.ReadAll(rc)
+		rc.Close()
+		want, _ := os.ReadFile(filepath.Join(dir, filepath.FromSlash(f.Name)))
+		if err != nil || !bytes.Equal(got, want) {
+			t.Errorf("entry %s doesn't match the file: %v", f.Name, err)
+		}
+	}
+}
+
+// BenchmarkWriteZip measures archive throughput by -zip-workers. On a
+// multi-core host the parallel runs should scale until the CPUs are busy.
+func BenchmarkWriteZip(b *testing.B) {
+	dir := b.TempDir()
+	total := writeTextTree(b, dir, 64, 256<<10)
+	for _, workers := range []int{1, 2, 4, 8} {
+		b.Run(fmt.Sprintf("workers=%d", workers), func(b *testing.B) {
+			b.SetBytes(total)
+			for range b.N {
+				if err := writeZip(io.Discard, dir, 6, workers, treeWalker{}); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+// BenchmarkCompressPool serves many compressed responses at once and
+// reports the most compressions seen running together, which stays at
+// -compress-workers however many requests are in flight.
+func BenchmarkCompressPool(b *testing.B) {
+	body := []byte(strings.Repeat("compressible text ", 16<<10))
+	handler := withGzip(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain")
+		_, _ = w.Write(body)
+	}), 0)
+	defer func(saved workerPool) { compressPool = saved }(compressPool)
+
+	for _, workers := range []int{runtime.GOMAXPROCS(0), 256} {
+		b.Run(fmt.Sprintf("workers=%d", workers), func(b *testing.B) {
+			compressPool = newWorkerPool(workers)
+			var peak atomic.Int64
+			stop := make(chan struct{})
+			sampled := make(chan struct{})
+			go func() {
+				defer close(sampled)
+				for {
+					select {
+					case <-stop:
+						return
+					default:
+					}
+					if n := int64(len(compressPool)); n > peak.Load() {
+						peak.Store(n)
+					}
+					runtime.Gosched()
+				}
+			}()
+
+			b.SetBytes(int64(len(body)))
+			b.SetParallelism(64)
+			b.RunParallel(func(pb *testing.PB) {
+				req := httptest.NewRequest("GET", "/", nil)
+				req.Header.Set("Accept-Encoding", "gzip")
+				for pb.Next() {
+					handler.ServeHTTP(httptest.NewRecorder(), req)
+				}
+			})
+			close(stop)
+			<-sampled
+			b.ReportMetric(float64(peak.Load()), "peak-compressions")
+			if peak.Load() > int64(workers) {
+				b.Errorf("%d compressions ran at once, want at most %d", peak.Load(), workers)
+			}
+		})
+	}
+}
+
+func TestHugeListingIsGzipped(t *testing.T) {
+	if testing.Short() {
+		t.Skip("creates 50,000 files")
+	}
+	const n = 50000
+	srv, dir := newTestServer(t, "-gzip")
+	for i := range n {
+		f, err := os.Create(filepath.Join(dir, fmt.Sprintf("entry-%05d.txt", i)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		f.Close()
+	}
+
+	resp, body := fetch(t, "GET", srv.URL+"/", nil, "Accept-Encoding: gzip")
+	if resp.Header.Get("Content-Encoding") != "gzip" {
+		t.Fatalf("Content-Encoding = %q, want gzip", resp.Header.Get("Content-Encoding"))
+	}
+	zr, err := gzip.NewReader(strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	html, err := io.ReadAll(zr)
+	if err != nil {
+		t.Fatalf("decoding the listing: %v", err)
+	}
+	if got := strings.Count(string(html), "<li>"); got != n {
+		t.Errorf("listing has %d entries, want %d", got, n)
+	}
+	if !strings.Contains(string(html), `href="/entry-49999.txt"`) || !strings.HasSuffix(string(html), "</html>\n") {
+		t.Errorf("listing is incomplete")
+	}
+	if len(body) >= len(html)/4 {
+		t.Errorf("compressed listing is %d bytes of %d, want it much smaller", len(body), len(html))
+	}
+}
+
+func TestChunkedMultipartUpload(t *testing.T) {
+	srv, dir := newTestServer(t)
+	content := strings.Repeat("chunked upload ", 64<<10)
+
+	pr, pw := io.Pipe()
+	mw := multipart.NewWriter(pw)
+	go func() {
+		_ = mw.WriteField("name", "up")
+		part, _ := mw.CreateFormFile("file", "data.txt")
+		// Several writes so the body goes out in more than one chunk
+		for i := 0; i < len(content); i += 32 << 10 {
+			_, _ = io.WriteString(part, content[i:min(i+32<<10, len(content))])
+		}
+		pw.CloseWithError(mw.Close())
+	}()
+	req, _ := http.NewRequest("POST", srv.URL+"/", pr)
+	req.Header.Set("Content-Type", mw.FormDataContentType())
+	if req.ContentLength != 0 {
+		t.Fatalf("ContentLength = %d, want the body sent chunked", req.ContentLength)
+	}
+	if resp, body := send(t, http.DefaultClient, req); resp.StatusCode != http.StatusOK {
+		t.Fatalf("chunked upload = %d %q, want 200", resp.StatusCode, body)
+	}
+	if b, err := os.ReadFile(filepath.Join(dir, "up", "data.txt")); err != nil || string(b) != content {
+		t.Errorf("stored %d bytes, %v; want %d", len(b), err, len(content))
+	}
+}
+
+func TestListingNotModified(t *testing.T) {
+	srv, dir := newTestServer(t, "-listing-cache-control", "max-age=60")
+	writeFile(t, dir, "sub/a.txt", "a")
+
+	resp, _ := fetch(t, "GET", srv.URL+"/sub/", nil)
+	lastModified := resp.Header.Get("Last-Modified")
+	if resp.StatusCode != http.StatusOK || lastModified == "" || resp.Header.Get("Cache-Control") != "max-age=60" {
+		t.Fatalf("listing = %d with Last-Modified %q and Cache-Control %q", resp.StatusCode, lastModified, resp.Header.Get("Cache-Control"))
+	}
+	if resp, body := fetch(t, "GET", srv.URL+"/sub/", nil, "If-Modified-Since: "+lastModified); resp.StatusCode != http.StatusNotModified || body != "" {
+		t.Errorf("unchanged listing = %d %q, want an empty 304", resp.StatusCode, body)
+	}
+
+	// Move the change well past Last-Modified's one second resolution
+	later := time.Now().Add(2 * time.Second)
+	writeFile(t, dir, "sub/b.txt", "b")
+	if err := os.Chtimes(filepath.Join(dir, "sub"), later, later); err != nil {
+		t.Fatal(err)
+	}
+	if resp, body := fetch(t, "GET", srv.URL+"/sub/", nil, "If-Modified-Since: "+lastModified); resp.StatusCode != http.StatusOK || !strings.Contains(body, "b.txt") {
+		t.Errorf("changed listing = %d, want 200 with the new entry", resp.StatusCode)
+	}
+}
+
+// patternReader yields n bytes of a repeating, checkable pattern.
+func patternReader(n int64) io.Reader {
+	return io.LimitReader(&repeatReader{pattern: []byte("0123456789abcdef")}, n)
+}
+
+type repeatReader struct {
+	pattern []byte
+	off     int
+}
+
+func (r *repeatReader) Read(b []byte) (int, error) {
+	for i := range b {
+		b[i] = r.pattern[r.off]
+		r.off = (r.off + 1) % len(r.pattern)
+	}
+	return len(b), nil
+}
+
+func TestLargeRawUpload(t *testing.T) {
+	const size = 64 << 20
+	srv, dir := newTestServer(t)
+
+	req, _ := http.NewRequest("POST", srv.URL+"/", patternReader(size))
+	req.ContentLength = size
+	req.Header.Set("X-Target-Path", "/raw/big.bin")
+	if resp, body := send(t, http.DefaultClient, req); resp.StatusCode != http.StatusCreated {
+		t.Fatalf("raw upload = %d %q, want 201", resp.StatusCode, body)
+	}
+	f, err := os.Open(filepath.Join(dir, "raw", "big.bin"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	want := sha256.New()
+	_, _ = io.Copy(want, patternReader(size))
+	got := sha256.New()
+	if n, err := io.Copy(got, f); err != nil || n != size || !bytes.Equal(got.Sum(nil), want.Sum(nil)) {
+		t.Errorf("stored %d bytes, %v; want the %d uploaded", n, err, size)
+	}
+
+	srv, dir = newTestServer(t, "-max-upload", "1024")
+	req, _ = http.NewRequest("POST", srv.URL+"/", patternReader(4096))
+	req.Header.Set("X-Target-Path", "/too-big.bin")
+	if resp, _ := send(t, http.DefaultClient, req); resp.StatusCode != http.StatusRequestEntityTooLarge {
+		t.Errorf("raw upload over -max-upload = %d, want 413", resp.StatusCode)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "too-big.bin")); !os.IsNotExist(err) {
+		t.Errorf("an oversized upload was kept: %v", err)
+	}
+}
+
+// fullDisk is a writer that fails like a full filesystem.
+type fullDisk struct{}
+
+func (fullDisk) Write([]byte) (int, error) {
+	return 0, &os.PathError{Op: "write", Path: "upload", Err: syscall.ENOSPC}
+}
+
+func TestDiskFullIs507(t *testing.T) {
+	_, err := io.Copy(fullDisk{}, strings.NewReader("data"))
+	rec := httptest.NewRecorder()
+	writeError(rec, copyError(err))
+	if rec.Code != http.StatusInsufficientStorage {
+		t.Errorf("full disk = %d %q, want 507", rec.Code, rec.Body.String())
+	}
+
+	// The copy failing part way leaves no partial file behind
+	dir := t.TempDir()
+	src := io.MultiReader(strings.NewReader("partial"), iotest.ErrReader(syscall.ENOSPC))
+	if _, err := writeTemp(src, dir); err == nil {
+		t.Fatal("writeTemp succeeded on a full disk")
+	} else {
+		rec := httptest.NewRecorder()
+		writeError(rec, err)
+		if rec.Code != http.StatusInsufficientStorage {
+			t.Errorf("full disk during upload = %d, want 507", rec.Code)
+		}
+	}
+	if entries, _ := os.ReadDir(dir); len(entries) != 0 {
+		t.Errorf("%d files left behind after a failed upload", len(entries))
+	}
+}
+
+func TestPermissionDeniedIs403(t *testing.T) {
+	srv, dir := newTestServer(t)
+	p := writeFile(t, dir, "locked.txt", "secret")
+	if err := os.Chmod(p, 0); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = os.Chmod(p, 0644) })
+	if f, err := os.Open(p); err == nil {
+		f.Close()
+		t.Skip("mode 000 doesn't stop this process from reading, e.g. as root")
+	}
+
+	if resp, body := fetch(t, "GET", srv.URL+"/locked.txt", nil); resp.StatusCode != http.StatusForbidden || strings.Contains(body, "secret") {
+		t.Errorf("unreadable file = %d %q, want 403", resp.StatusCode, body)
+	}
+	if resp, _ := fetch(t, "GET", srv.URL+"/missing.txt", nil); resp.StatusCode != http.StatusNotFound {
+		t.Errorf("missing file = %d, want 404", resp.StatusCode)
+	}
+}
+
+func TestTraceIs405(t *testing.T) {
+	// Refused before authentication gets a say
+	srv, dir := newTestServer(t, "-htpasswd", writeFile(t, t.TempDir(), "htpasswd", "user:pass\n"))
+	writeFile(t, dir, "a.txt", "a")
+
+	for _, method := range []string{"TRACE", "TRACK"} {
+		resp, body := fetch(t, method, srv.URL+"/a.txt", nil, "X-Echo: probe")
+		if resp.StatusCode != http.StatusMethodNotAllowed || strings.Contains(body, "probe") {
+			t.Errorf("%s = %d %q, want 405 without echoing the request", method, resp.StatusCode, body)
+		}
+		if allow := resp.Header.Get("Allow"); allow == "" || strings.Contains(allow, "TRACE") {
+			t.Errorf("%s Allow = %q", method, allow)
+		}
+	}
+}
+
+// multipartBody encodes a form with the name field and one file.
+func multipartBody(t *testing.T, dirName, fileName, content string) (io.Reader, string) {
+	t.Helper()
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	if err := mw.WriteField("name", dirName); err != nil {
+		t.Fatal(err)
+	}
+	part, err := mw.CreateFormFile("file", fileName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _ = io.WriteString(part, content)
+	if err := mw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return &body, mw.FormDataContentType()
+}
+
+func TestMultipartTempFilesRemoved(t *testing.T) {
+	tmp := t.TempDir()
+	for _, env := range []string{"TMPDIR", "TMP", "TEMP"} {
+		t.Setenv(env, tmp)
+	}
+	// -method-override hands the handler a copy of the request, so the
+	// server's own cleanup of the original can't cover for the handler
+	srv, dir := newTestServer(t, "-multipart-mem", "1024", "-method-override")
+	content := strings.Repeat("spilled to disk ", 64<<10)
+
+	for _, want := range []int{http.StatusOK, http.StatusConflict} {
+		body, ctype := multipartBody(t, "up", "big.txt", content)
+		if resp, _ := fetch(t, "POST", srv.URL+"/", body, "Content-Type: "+ctype); resp.StatusCode != want {
+			t.Fatalf("upload = %d, want %d", resp.StatusCode, want)
+		}
+		if entries, _ := os.ReadDir(tmp); len(entries) != 0 {
+			t.Errorf("%d multipart temp files left after a %d upload, e.g. %s", len(entries), want, entries[0].Name())
+		}
+	}
+	if b, err := os.ReadFile(filepath.Join(dir, "up", "big.txt")); err != nil || string(b) != content {
+		t.Errorf("stored %d bytes, %v", len(b), err)
+	}
+}
+
+func TestNoUploadNoDelete(t *testing.T) {
+	for _, tc := range []struct {
+		args           []string
+		upload, delete bool
+		allow          string
+	}{
+		{nil, true, true, "GET, HEAD, PUT, POST, DELETE"},
+		{[]string{"-no-upload"}, false, true, "GET, HEAD, DELETE"},
+		{[]string{"-no-delete"}, true, false, "GET, HEAD, PUT, POST"},
+		{[]string{"-no-upload", "-no-delete"}, false, false, "GET, HEAD"},
+	} {
+		t.Run(strings.Join(append([]string{"flags"}, tc.args...), " "), func(t *testing.T) {
+			srv, dir := newTestServer(t, tc.args...)
+			writeFile(t, dir, "a.txt", "a")
+
+			check := func(allowed bool, method, target string, body io.Reader, headers ...string) {
+				t.Helper()
+				resp, _ := fetch(t, method, srv.URL+target, body, headers...)
+				if allowed && resp.StatusCode >= 300 {
+					t.Errorf("%s = %d, want it served", method, resp.StatusCode)
+				}
+				if !allowed && (resp.StatusCode != http.StatusMethodNotAllowed || resp.Header.Get("Allow") != tc.allow) {
+					t.Errorf("%s = %d with Allow %q, want 405 with %q", method, resp.StatusCode, resp.Header.Get("Allow"), tc.allow)
+				}
+			}
+			check(tc.upload, "PUT", "/put.txt", strings.NewReader("p"))
+			body, ctype := multipartBody(t, "up", "post.txt", "p")
+			check(tc.upload, "POST", "/", body, "Content-Type: "+ctype)
+			check(tc.delete, "DELETE", "/a.txt", nil)
+			check(true, "GET", "/", nil)
+		})
+	}
+}
+
+func TestExpectContinueRejectedBeforeBody(t *testing.T) {
+	for _, tc := range []struct {
+		args []string
+		want int
+	}{
+		{[]string{"-no-upload"}, http.StatusMethodNotAllowed},
+		{[]string{"-max-upload", "1024"}, http.StatusRequestEntityTooLarge},
+	} {
+		srv, _ := newTestServer(t, tc.args...)
+		conn, err := net.Dial("tcp", srv.Listener.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		_ = conn.SetDeadline(time.Now().Add(5 * time.Second))
+		// The headers promise a body that is never sent
+		_, _ = io.WriteString(conn, "POST /up.bin HTTP/1.1\r\nHost: gopi\r\nX-Target-Path: /up.bin\r\nContent-Length: 104857600\r\nExpect: 100-continue\r\n\r\n")
+		resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+		conn.Close()
+		if err != nil {
+			t.Fatalf("%v: reading the response: %v", tc.args, err)
+		}
+		if resp.StatusCode != tc.want {
+			t.Errorf("%v: status = %d, want %d without asking for the body", tc.args, resp.StatusCode, tc.want)
+		}
+	}
+}
+
+func TestListingSurvivesConcurrentDeletes(t *testing.T) {
+	dir := t.TempDir()
+	for i := range 20 {
+		writeFile(t, dir, fmt.Sprintf("f%02d", i), "x")
+	}
+	files, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, file := range files[:10] {
+		os.Remove(filepath.Join(dir, file.Name()))
+	}
+	// Windows hands back each entry's info with the directory read, so
+	// only elsewhere does Info notice the deletion
+	if entries := newListingEntries(files); runtime.GOOS != "windows" && (len(entries) != 10 || entries[0].Name != "f10") {
+		t.Errorf("listing kept %d entries, want only the 10 still there", len(entries))
+	}
+
+	srv, root := newTestServer(t)
+	stop := make(chan struct{})
+	churned := make(chan struct{})
+	go func() {
+		defer close(churned)
+		for i := 0; ; i++ {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			sub := filepath.Join(root, "churn")
+			for j := range 50 {
+				_ = os.MkdirAll(sub, 0755)
+				_ = os.WriteFile(filepath.Join(sub, fmt.Sprintf("f%d-%d", i, j)), nil, 0644)
+			}
+			_ = os.RemoveAll(sub)
+		}
+	}()
+	for range 200 {
+		if resp, body := fetch(t, "GET", srv.URL+"/churn/", nil); resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusNotFound {
+			t.Errorf("listing a directory being deleted = %d %q, want 200 or 404", resp.StatusCode, body)
+			break
+		}
+	}
+	close(stop)
+	<-churned
+}
+
+func TestResumableChunkOrder(t *testing.T) {
+	srv, dir := newTestServer(t)
+	content := "0123456789ABCDEFGHIJ"
+	put := func(start, end int) *http.Response {
+		t.Helper()
+		resp, _ := fetch(t, "PUT", srv.URL+"/chunks.txt", strings.NewReader(content[start:end+1]), fmt.Sprintf("Content-Range: bytes %d-%d/%d", start, end, len(content)))
+		return resp
+	}
+
+	// A chunk past what has arrived is refused with the offset to resume at
+	if resp := put(5, 9); resp.StatusCode != http.StatusRequestedRangeNotSatisfiable || resp.Header.Get("X-Expected-Offset") != "0" {
+		t.Errorf("gapped first chunk = %d, offset %q; want 416 at 0", resp.StatusCode, resp.Header.Get("X-Expected-Offset"))
+	}
+	if resp := put(0, 4); resp.StatusCode != http.StatusAccepted || resp.Header.Get("X-Expected-Offset") != "5" {
+		t.Errorf("first chunk = %d, offset %q; want 202 at 5", resp.StatusCode, resp.Header.Get("X-Expected-Offset"))
+	}
+	if resp := put(10, 14); resp.StatusCode != http.StatusRequestedRangeNotSatisfiable || resp.Header.Get("X-Expected-Offset") != "5" {
+		t.Errorf("out-of-order chunk = %d, offset %q; want 416 at 5", resp.StatusCode, resp.Header.Get("X-Expected-Offset"))
+	}
+	// Overlap with what is already there is fine
+	if resp := put(3, 9); resp.StatusCode != http.StatusAccepted || resp.Header.Get("X-Expected-Offset") != "10" {
+		t.Errorf("overlapping chunk = %d, offset %q; want 202 at 10", resp.StatusCode, resp.Header.Get("X-Expected-Offset"))
+	}
+	if _, err := os.Stat(filepath.Join(dir, "chunks.txt")); !os.IsNotExist(err) {
+		t.Fatalf("an incomplete upload is visible: %v", err)
+	}
+	if resp := put(10, 19); resp.StatusCode != http.StatusCreated {
+		t.Errorf("last chunk = %d, want 201", resp.StatusCode)
+	}
+	if b, err := os.ReadFile(filepath.Join(dir, "chunks.txt")); err != nil || string(b) != content {
+		t.Errorf("assembled %q, %v; want %q", b, err, content)
+	}
+}
+
+func TestHeadZip(t *testing.T) {
+	srv, dir := newTestServer(t)
+	writeTextTree(t, filepath.Join(dir, "docs"), 5, 4096)
+
+	resp, body := fetch(t, "HEAD", srv.URL+"/docs/?format=zip", nil)
+	if resp.StatusCode != http.StatusOK || body != "" || resp.Header.Get("Accept-Ranges") != "bytes" {
+		t.Fatalf("HEAD = %d, %d body bytes, Accept-Ranges %q", resp.StatusCode, len(body), resp.Header.Get("Accept-Ranges"))
+	}
+	_, archive := fetch(t, "GET", srv.URL+"/docs/?format=zip", nil)
+	if resp.ContentLength != int64(len(archive)) {
+		t.Errorf("HEAD Content-Length = %d, want the archive's %d", resp.ContentLength, len(archive))
+	}
+
+	srv = serveDir(t, dir, "-zip-prebuild-max", "0")
+	resp, body = fetch(t, "HEAD", srv.URL+"/docs/?format=zip", nil)
+	if resp.StatusCode != http.StatusOK || body != "" || resp.Header.Get("Accept-Ranges") != "none" || resp.Header.Get("Content-Length") != "" {
+		t.Errorf("streamed HEAD = %d with Accept-Ranges %q and Content-Length %q, want 200, none and no length", resp.StatusCode, resp.Header.Get("Accept-Ranges"), resp.Header.Get("Content-Length"))
+	}
+}
+
+func TestZipLevelZeroStores(t *testing.T) {
+	dir := t.TempDir()
+	writeTextTree(t, filepath.Join(dir, "docs"), 8, 16<<10)
+	archive := func(args ...string) []byte {
+		t.Helper()
+		srv := serveDir(t, dir, args...)
+		resp, body := fetch(t, "GET", srv.URL+"/docs/?format=zip", nil)
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("%v: download = %d", args, resp.StatusCode)
+		}
+		return []byte(body)
+	}
+	stored, deflated := archive("-zip-level", "0"), archive("-zip-level", "9")
+	if len(stored) <= len(deflated) {
+		t.Errorf("level 0 archive is %d bytes, level 9 %d; want level 0 larger", len(stored), len(deflated))
+	}
+
+	zr, err := zip.NewReader(bytes.NewReader(stored), int64(len(stored)))
+	if err != nil {
+		t.Fatalf("level 0 archive is invalid: %v", err)
+	}
+	var files int
+	for _, f := range zr.File {
+		if strings.HasSuffix(f.Name, "/") {
+			continue
+		}
+		files++
+		if f.Method != zip.Store {
+			t.Errorf("%s uses method %d, want store", f.Name, f.Method)
+		}
+		rc, err := f.Open()
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := io.ReadAll(rc)
+		rc.Close()
+		want, _ := os.ReadFile(filepath.Join(dir, "docs", filepath.FromSlash(f.Name)))
+		if err != nil || !bytes.Equal(got, want) {
+			t.Errorf("%s doesn't match the file: %v", f.Name, err)
+		}
+	}
+	if files != 8 {
+		t.Errorf("level 0 archive has %d files, want 8", files)
+	}
+
+	srv := serveDir(t, dir, "-zip-level", "0")
+	_, body := fetch(t, "GET", srv.URL+"/docs/?format=tar.gz", nil)
+	gz, err := gzip.NewReader(strings.NewReader(body))
+	if err != nil {
+		t.Fatalf("level 0 tar.gz is invalid: %v", err)
+	}
+	tr := tar.NewReader(gz)
+	files = 0
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			t.Fatalf("level 0 tar.gz is invalid: %v", err)
+		}
+		if header.Typeflag == tar.TypeReg {
+			files++
+		}
+	}
+	if files != 8 {
+		t.Errorf("level 0 tar.gz has %d files, want 8", files)
+	}
+}
+
+func TestResumedDownload(t *testing.T) {
+	srv, dir := newTestServer(t)
+	content := strings.Repeat("resumable ", 1000)
+	p := writeFile(t, dir, "dl.txt", content)
+
+	// The first attempt is cut off after 100 bytes
+	resp, first := fetch(t, "GET", srv.URL+"/dl.txt", nil, "Range: bytes=0-99")
+	etag := resp.Header.Get("ETag")
+	if resp.StatusCode != http.StatusPartialContent || resp.Header.Get("Accept-Ranges") != "bytes" || etag == "" {
+		t.Fatalf("first attempt = %d with Accept-Ranges %q and ETag %q", resp.StatusCode, resp.Header.Get("Accept-Ranges"), etag)
+	}
+	resp, rest := fetch(t, "GET", srv.URL+"/dl.txt", nil, "Range: bytes=100-", "If-Range: "+etag)
+	if resp.StatusCode != http.StatusPartialContent || first+rest != content {
+		t.Errorf("resume = %d, reassembled %d of %d bytes", resp.StatusCode, len(first+rest), len(content))
+	}
+
+	// Once the file changes, resuming starts over with the new bytes
+	changed := strings.Repeat("CHANGED!! ", 1200)
+	writeFile(t, dir, "dl.txt", changed)
+	later := time.Now().Add(time.Minute)
+	if err := os.Chtimes(p, later, later); err != nil {
+		t.Fatal(err)
+	}
+	resp, body := fetch(t, "GET", srv.URL+"/dl.txt", nil, "Range: bytes=100-", "If-Range: "+etag)
+	if resp.StatusCode != http.StatusOK || body != changed || resp.Header.Get("ETag") == etag {
+		t.Errorf("resume after a change = %d with %d bytes, want 200 with the whole new file", resp.StatusCode, len(body))
+	}
+}
+
+func TestOnConflictRename(t *testing.T) {
+	srv, dir := newTestServer(t, "-on-conflict", "rename")
+
+	var stored []string
+	for i := range 3 {
+		resp, _ := fetch(t, "PUT", srv.URL+"/up/report.txt", strings.NewReader(fmt.Sprint("version ", i)))
+		if resp.StatusCode != http.StatusCreated {
+			t.Fatalf("upload %d = %d, want 201", i, resp.StatusCode)
+		}
+		stored = append(stored, resp.Header.Get("X-Stored-Path"))
+	}
+	for i, name := range []string{"report.txt", "report (1).txt", "report (2).txt"} {
+		if !strings.HasSuffix(stored[i], name) {
+			t.Errorf("upload %d stored at %q, want %s", i, stored[i], name)
+		}
+		if b, err := os.ReadFile(filepath.Join(dir, "up", name)); err != nil || string(b) != fmt.Sprint("version ", i) {
+			t.Errorf("%s = %q, %v", name, b, err)
+		}
+	}
+}
+
+func TestByteQuotas(t *testing.T) {
+	srv, dir := newTestServer(t, "-per-ip-download-quota", "1000", "-per-ip-upload-quota", "1000")
+	writeFile(t, dir, "a.txt", strings.Repeat("d", 600))
+
+	for i, want := range []int{http.StatusOK, http.StatusOK, http.StatusTooManyRequests} {
+		if resp, _ := fetch(t, "GET", srv.URL+"/a.txt", nil); resp.StatusCode != want {
+			t.Errorf("download %d = %d, want %d", i, resp.StatusCode, want)
+		} else if want == http.StatusTooManyRequests && resp.Header.Get("Retry-After") == "" {
+			t.Errorf("download over quota has no Retry-After")
+		}
+	}
+
+	if resp, _ := fetch(t, "PUT", srv.URL+"/one.txt", strings.NewReader(strings.Repeat("u", 800))); resp.StatusCode != http.StatusCreated {
+		t.Errorf("upload within quota = %d, want 201", resp.StatusCode)
+	}
+	if resp, _ := fetch(t, "PUT", srv.URL+"/two.txt", strings.NewReader(strings.Repeat("u", 400))); resp.StatusCode != http.StatusTooManyRequests {
+		t.Errorf("upload overrunning quota = %d, want 429", resp.StatusCode)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "two.txt")); !os.IsNotExist(err) {
+		t.Errorf("an upload over quota was stored: %v", err)
+	}
+}
+
+func TestGzipSkipsSmallResponses(t *testing.T) {
+	srv, dir := newTestServer(t, "-gzip")
+	writeFile(t, dir, "small.txt", strings.Repeat("s", 100))
+	writeFile(t, dir, "large.txt", strings.Repeat("l", 4096))
+	writeFile(t, dir, "empty/only.txt", "")
+
+	for _, tc := range []struct {
+		path       string
+		compressed bool
+	}{
+		{"/small.txt", false},
+		{"/large.txt", true},
+		// A listing's length isn't known up front, so it is buffered to decide
+		{"/empty/", false},
+	} {
+		resp, body := fetch(t, "GET", srv.URL+tc.path, nil, "Accept-Encoding: gzip")
+		if got := resp.Header.Get("Content-Encoding") == "gzip"; got != tc.compressed {
+			t.Errorf("%s (%d bytes) compressed = %v, want %v", tc.path, len(body), got, tc.compressed)
+		}
+	}
+	if _, body := fetch(t, "GET", srv.URL+"/small.txt", nil, "Accept-Encoding: gzip"); body != strings.Repeat("s", 100) {
+		t.Errorf("small body = %q", body)
+	}
+}
+
+func TestMimeOverrides(t *testing.T) {
+	types := writeFile(t, t.TempDir(), "mime.types", "# comment\napplication/x-gopi-file  gopifile gopifile2\n")
+	srv, dir := newTestServer(t, "-mime", ".wasm=application/wasm", "-mime", ".webmanifest=application/manifest+json", "-mime-types", types)
+
+	for name, want := range map[string]string{
+		"app.wasm":         "application/wasm",
+		"site.webmanifest": "application/manifest+json",
+		"data.gopifile":    "application/x-gopi-file",
+		"data.gopifile2":   "application/x-gopi-file",
+	} {
+		writeFile(t, dir, name, "x")
+		resp, _ := fetch(t, "GET", srv.URL+"/"+name, nil)
+		if got := resp.Header.Get("Content-Type"); !strings.HasPrefix(got, want) {
+			t.Errorf("%s Content-Type = %q, want %s", name, got, want)
+		}
+	}
+}
+
+func TestUnsatisfiableRange(t *testing.T) {
+	srv, dir := newTestServer(t)
+	writeFile(t, dir, "small.txt", "0123456789")
+
+	for _, ranges := range []string{"bytes=99999999-", "bytes=10-20", "bytes=-0"} {
+		resp, body := fetch(t, "GET", srv.URL+"/small.txt", nil, "Range: "+ranges)
+		if resp.StatusCode != http.StatusRequestedRangeNotSatisfiable || resp.Header.Get("Content-Range") != "bytes */10" {
+			t.Errorf("%s = %d with Content-Range %q, want 416 with bytes */10", ranges, resp.StatusCode, resp.Header.Get("Content-Range"))
+		}
+		if strings.Contains(body, "0123456789") {
+			t.Errorf("%s sent the file anyway", ranges)
+		}
+	}
+	if resp, body := fetch(t, "GET", srv.URL+"/small.txt", nil, "Range: bytes=5-99999999"); resp.StatusCode != http.StatusPartialContent || body != "56789" {
+		t.Errorf("range running past the end = %d %q, want 206 56789", resp.StatusCode, body)
+	}
+}
+
+func TestGzipIntegrityTrailers(t *testing.T) {
+	srv, dir := newTestServer(t, "-gzip")
+	content := strings.Repeat("check me ", 4096)
+	writeFile(t, dir, "doc.txt", content)
+
+	resp, body := fetch(t, "GET", srv.URL+"/doc.txt", nil, "Accept-Encoding: gzip", "TE: trailers")
+	if resp.Header.Get("Content-Encoding") != "gzip" {
+		t.Fatalf("Content-Encoding = %q, want gzip", resp.Header.Get("Content-Encoding"))
+	}
+	zr, err := gzip.NewReader(strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	plain, err := io.ReadAll(zr)
+	if err != nil || string(plain) != content {
+		t.Fatalf("decoded %d bytes, %v", len(plain), err)
+	}
+	sum := sha256.Sum256([]byte(content))
+	if got := resp.Trailer.Get("X-Uncompressed-Length"); got != strconv.Itoa(len(content)) {
+		t.Errorf("X-Uncompressed-Length = %q, want %d", got, len(content))
+	}
+	if got := resp.Trailer.Get("X-Content-SHA256"); got != hex.EncodeToString(sum[:]) {
+		t.Errorf("X-Content-SHA256 = %q, want %x", got, sum)
+	}
+
+	// Without TE: trailers nothing is announced
+	if resp, _ := fetch(t, "GET", srv.URL+"/doc.txt", nil, "Accept-Encoding: gzip"); len(resp.Trailer) != 0 {
+		t.Errorf("trailers sent unasked: %v", resp.Trailer)
+	}
+}
+
+func TestContentDispositionNames(t *testing.T) {
+	srv, dir := newTestServer(t)
+
+	for _, name := range []string{`say "hi".txt`, "a;b=c.txt", "party 🎉.txt", `back\slash.txt`, "tab\there.txt"} {
+		writeFile(t, dir, name, "x")
+		resp, _ := fetch(t, "GET", srv.URL+"/"+url.PathEscape(name)+"?download=1", nil)
+		header := resp.Header.Get("Content-Disposition")
+		if resp.StatusCode != http.StatusOK || strings.ContainsAny(header, "\r\n\t") {
+			t.Errorf("%q: %d with Content-Disposition %q", name, resp.StatusCode, header)
+			continue
+		}
+		disposition, params, err := mime.ParseMediaType(header)
+		if err != nil || disposition != "attachment" {
+			t.Errorf("%q: malformed Content-Disposition %q: %v", name, header, err)
+			continue
+		}
+		// Control characters are dropped from the name
+		if want := strings.ReplaceAll(name, "\t", ""); params["filename"] != want {
+			t.Errorf("%q: download name = %q from %q", name, params["filename"], header)
+		}
+	}
+}
+
+func TestReadOnlyFilesystem(t *testing.T) {
+	rec := httptest.NewRecorder()
+	writeError(rec, withDetail(&statusError{http.StatusInternalServerError, "Unable to create file"}, &os.PathError{Op: "open", Path: "x", Err: syscall.EROFS}))
+	if rec.Code != http.StatusForbidden || !strings.Contains(rec.Body.String(), "read-only") {
+		t.Errorf("EROFS = %d %q, want 403 naming the read-only filesystem", rec.Code, rec.Body.String())
+	}
+
+	// The real thing needs a read-only mount, which takes privileges
+	dir := t.TempDir()
+	if err := exec.Command("mount", "-t", "tmpfs", "-o", "size=1m", "tmpfs", dir).Run(); err != nil {
+		t.Skipf("can't mount a filesystem here: %v", err)
+	}
+	t.Cleanup(func() { _ = exec.Command("umount", dir).Run() })
+	writeFile(t, dir, "a.txt", "a")
+	if out, err := exec.Command("mount", "-o", "remount,ro", dir).CombinedOutput(); err != nil {
+		t.Skipf("can't remount read-only: %v %s", err, out)
+	}
+	srv := serveDir(t, dir)
+
+	body, ctype := multipartBody(t, "new", "b.txt", "b")
+	for _, tc := range []struct {
+		method, path string
+		body         io.Reader
+		headers      []string
+	}{
+		{"PUT", "/b.txt", strings.NewReader("b"), nil},
+		{"POST", "/", body, []string{"Content-Type: " + ctype}},
+		{"DELETE", "/a.txt", nil, nil},
+	} {
+		if resp, msg := fetch(t, tc.method, srv.URL+tc.path, tc.body, tc.headers...); resp.StatusCode != http.StatusForbidden || !strings.Contains(msg, "read-only") {
+			t.Errorf("%s %s on a read-only mount = %d %q, want 403", tc.method, tc.path, resp.StatusCode, msg)
+		}
+	}
+}
+
+func TestUploadMtime(t *testing.T) {
+	srv, dir := newTestServer(t)
+	want := time.Date(2020, 5, 17, 8, 30, 0, 0, time.UTC)
+
+	for name, header := range map[string]string{
+		"rfc3339.txt": want.Format(time.RFC3339),
+		"unix.txt":    strconv.FormatInt(want.Unix(), 10),
+		"bad.txt":     "last tuesday",
+	} {
+		if resp, _ := fetch(t, "PUT", srv.URL+"/"+name, strings.NewReader("x"), "X-File-Mtime: "+header); resp.StatusCode != http.StatusCreated {
+			t.Fatalf("upload with X-File-Mtime %q = %d, want 201", header, resp.StatusCode)
+		}
+		info, err := os.Stat(filepath.Join(dir, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if name == "bad.txt" {
+			if time.Since(info.ModTime()) > time.Minute {
+				t.Errorf("malformed X-File-Mtime set mtime %v, want it ignored", info.ModTime())
+			}
+		} else if !info.ModTime().Equal(want) {
+			t.Errorf("X-File-Mtime %q gave mtime %v, want %v", header, info.ModTime(), want)
+		}
+	}
+}
+
+func TestFailedUploadLeavesNoDirectory(t *testing.T) {
+	srv, dir := newTestServer(t, "-max-disk-usage", "100")
+	writeFile(t, dir, "existing/.keep", "")
+
+	for _, tc := range []struct{ dir, file, content string }{
+		{"new", "big.txt", strings.Repeat("x", 1000)},
+		{"manifest", ".gopi.json", "{}"},
+		{"existing", "big.txt", strings.Repeat("x", 1000)},
+	} {
+		body, ctype := multipartBody(t, tc.dir, tc.file, tc.content)
+		if resp, _ := fetch(t, "POST", srv.URL+"/", body, "Content-Type: "+ctype); resp.StatusCode < 400 {
+			t.Errorf("upload of %s/%s = %d, want it to fail", tc.dir, tc.file, resp.StatusCode)
+		}
+	}
+	for _, name := range []string{"new", "manifest"} {
+		if _, err := os.Stat(filepath.Join(dir, name)); !os.IsNotExist(err) {
+			t.Errorf("failed upload left directory %s behind: %v", name, err)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(dir, "existing")); err != nil {
+		t.Errorf("failed upload removed a directory it didn't create: %v", err)
+	}
+
+	body, ctype := multipartBody(t, "ok", "small.txt", "x")
+	if resp, _ := fetch(t, "POST", srv.URL+"/", body, "Content-Type: "+ctype); resp.StatusCode != http.StatusOK {
+		t.Errorf("upload within quota = %d, want 200", resp.StatusCode)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "ok", "small.txt")); err != nil {
+		t.Errorf("successful upload missing: %v", err)
+	}
+}
+
+func TestFormWithoutFilesLeavesNoDirectory(t *testing.T) {
+	srv, dir := newTestServer(t)
+
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	_ = mw.WriteField("name", "empty")
+	if err := mw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if resp, _ := fetch(t, "POST", srv.URL+"/", &body, "Content-Type: "+mw.FormDataContentType()); resp.StatusCode != http.StatusOK {
+		t.Errorf("form with no files = %d, want 200", resp.StatusCode)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "empty")); !os.IsNotExist(err) {
+		t.Errorf("form with no files left directory behind: %v", err)
+	}
+}
+
+func TestFormUploadNameErrors(t *testing.T) {
+	srv, _ := newTestServer(t)
+	for _, tc := range []struct {
+		name string
+		want int
+	}{
+		{".gopi-parts", http.StatusNotFound},
+		{".gopi.json", http.StatusForbidden},
+	} {
+		body, ctype := multipartBody(t, tc.name, "a.txt", "x")
+		if resp, text := fetch(t, "POST", srv.URL+"/", body, "Content-Type: "+ctype); resp.StatusCode != tc.want {
+			t.Errorf("form upload into %q = %d %q, want %d", tc.name, resp.StatusCode, text, tc.want)
+		}
+	}
+}
+
+func TestConcurrentUploadsHoldQuota(t *testing.T) {
+	srv, dir := newTestServer(t, "-max-disk-usage", "1000")
+
+	// The first upload stalls mid-body, so its bytes are only reserved
+	pr, pw := io.Pipe()
+	req, err := http.NewRequest("PUT", srv.URL+"/slow.txt", pr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.ContentLength = 600
+	done := make(chan int)
+	go func() {
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			done <- 0
+			return
+		}
+		resp.Body.Close()
+		done <- resp.StatusCode
+	}()
+	if _, err := pw.Write([]byte(strings.Repeat("x", 100))); err != nil {
+		t.Fatal(err)
+	}
+	for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(10 * time.Millisecond) {
+		if entries, _ := os.ReadDir(dir); len(entries) > 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("stalled upload never started writing")
+		}
+	}
+
+	if resp, _ := fetch(t, "PUT", srv.URL+"/other.txt", strings.NewReader(strings.Repeat("y", 600))); resp.StatusCode != http.StatusInsufficientStorage {
+		t.Errorf("upload overlapping a reserved one = %d, want 507", resp.StatusCode)
+	}
+	if resp, _ := fetch(t, "PUT", srv.URL+"/small.txt", strings.NewReader(strings.Repeat("y", 300))); resp.StatusCode != http.StatusCreated {
+		t.Errorf("upload within what is left = %d, want 201", resp.StatusCode)
+	}
+
+	pw.Write([]byte(strings.Repeat("x", 500)))
+	pw.Close()
+	if status := <-done; status != http.StatusCreated {
+		t.Errorf("stalled upload = %d, want 201", status)
+	}
+	if resp, _ := fetch(t, "PUT", srv.URL+"/late.txt", strings.NewReader(strings.Repeat("z", 200))); resp.StatusCode != http.StatusInsufficientStorage {
+		t.Errorf("upload past the stored total = %d, want 507", resp.StatusCode)
+	}
+}
+
+func TestAuditLog(t *testing.T) {
+	logFile := filepath.Join(t.TempDir(), "audit.jsonl")
+	srv, _ := newTestServer(t, "-audit-log", logFile)
+
+	if resp, _ := fetch(t, "PUT", srv.URL+"/a.txt", strings.NewReader("a")); resp.StatusCode != http.StatusCreated {
+		t.Fatalf("upload = %d", resp.StatusCode)
+	}
+	if resp, _ := fetch(t, "DELETE", srv.URL+"/a.txt", nil); resp.StatusCode != http.StatusOK {
+		t.Fatalf("delete = %d", resp.StatusCode)
+	}
+	fetch(t, "DELETE", srv.URL+"/missing.txt", nil)
+
+	data, err := os.ReadFile(logFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var records []auditRecord
+	for _, line := range strings.Split(strings.TrimSpace(string(data)), "\n") {
+		var rec auditRecord
+		if err := json.Unmarshal([]byte(line), &rec); err != nil {
+			t.Fatalf("audit line %q: %v", line, err)
+		}
+		records = append(records, rec)
+	}
+	want := []struct{ op, path string }{{"upload", "/a.txt"}, {"delete", "/a.txt"}, {"delete", "/missing.txt"}}
+	if len(records) != len(want) {
+		t.Fatalf("audit log has %d records, want %d:\n%s", len(records), len(want), data)
+	}
+	for i, rec := range records {
+		if rec.Op != want[i].op || rec.Path != want[i].path || rec.ClientIP != "127.0.0.1" || rec.Time.IsZero() {
+			t.Errorf("record %d = %+v, want %s of %s", i, rec, want[i].op, want[i].path)
+		}
+		if ok := rec.Result == "ok"; ok != (i < 2) {
+			t.Errorf("record %d result = %q", i, rec.Result)
+		}
+	}
+}
+
+func TestAuditLogRecordsRenamedUpload(t *testing.T) {
+	logFile := filepath.Join(t.TempDir(), "audit.jsonl")
+	srv, dir := newTestServer(t, "-audit-log", logFile, "-on-conflict", "rename")
+	writeFile(t, dir, "a.txt", "old")
+
+	resp, _ := fetch(t, "PUT", srv.URL+"/a.txt", strings.NewReader("new"))
+	stored := resp.Header.Get("X-Stored-Path")
+	if resp.StatusCode != http.StatusCreated || stored == "/a.txt" {
+		t.Fatalf("upload over an existing file = %d stored at %q, want it renamed", resp.StatusCode, stored)
+	}
+	data, err := os.ReadFile(logFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var rec auditRecord
+	if err := json.Unmarshal(bytes.TrimSpace(data), &rec); err != nil {
+		t.Fatalf("audit log %q: %v", data, err)
+	}
+	if rec.Op != "upload" || rec.Path != stored {
+		t.Errorf("audit record = %+v, want upload of %s", rec, stored)
+	}
+}
+
+func TestMaintenanceRetryAfterRoundsUp(t *testing.T) {
+	srv, _ := newTestServer(t, "-maintenance", "-maintenance-retry-after", "1500ms")
+	resp, _ := fetch(t, "GET", srv.URL+"/", nil)
+	if resp.StatusCode != http.StatusServiceUnavailable {
+		t.Fatalf("GET in maintenance = %d, want 503", resp.StatusCode)
+	}
+	if got := resp.Header.Get("Retry-After"); got != "2" {
+		t.Errorf("Retry-After = %q, want 2", got)
+	}
+}
+
+func TestReadCacheFillsOnFullGet(t *testing.T) {
+	cacheDir := t.TempDir()
+	srv, dir := newTestServer(t, "-read-cache-dir", cacheDir)
+	writeFile(t, dir, "big.txt", "0123456789")
+	cached := func() int {
+		files, _ := filepath.Glob(filepath.Join(cacheDir, "*"+readCacheSuffix))
+		return len(files)
+	}
+
+	fetch(t, "HEAD", srv.URL+"/big.txt", nil)
+	if resp, body := fetch(t, "GET", srv.URL+"/big.txt", nil, "Range: bytes=2-4"); resp.StatusCode != http.StatusPartialContent || body != "234" {
+		t.Errorf("range before caching = %d %q", resp.StatusCode, body)
+	}
+	if n := cached(); n != 0 {
+		t.Errorf("HEAD and Range filled %d cache entries, want none", n)
+	}
+
+	if _, body := fetch(t, "GET", srv.URL+"/big.txt", nil); body != "0123456789" {
+		t.Errorf("full GET = %q", body)
+	}
+	if n := cached(); n != 1 {
+		t.Errorf("full GET left %d cache entries, want 1", n)
+	}
+	if resp, body := fetch(t, "GET", srv.URL+"/big.txt", nil, "Range: bytes=2-4"); resp.StatusCode != http.StatusPartialContent || body != "234" {
+		t.Errorf("range from the cache = %d %q", resp.StatusCode, body)
+	}
+}
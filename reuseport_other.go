@@ -0,0 +1,14 @@
+//go:build !unix
+
+package main
+
+import "errors"
+
+// soReusePort reports that SO_REUSEPORT isn't supported on this platform.
+func soReusePort() (int, bool) {
+	return 0, false
+}
+
+func setReusePort(fd uintptr, opt int) error {
+	return errors.New("SO_REUSEPORT is not supported")
+}
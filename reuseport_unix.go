@@ -0,0 +1,30 @@
+//go:build unix
+
+package main
+
+import (
+	"runtime"
+	"strings"
+	"syscall"
+)
+
+// soReusePort returns the SO_REUSEPORT option number for this platform. The
+// syscall package doesn't export it for Linux, so the kernel ABI values are
+// spelled out here.
+func soReusePort() (int, bool) {
+	switch runtime.GOOS {
+	case "linux":
+		if strings.HasPrefix(runtime.GOARCH, "mips") {
+			return 0x200, true
+		}
+		return 0xf, true
+	case "darwin", "freebsd", "netbsd", "openbsd", "dragonfly":
+		return 0x200, true
+	}
+	return 0, false
+}
+
+// setReusePort turns the socket option opt on for the socket fd.
+func setReusePort(fd uintptr, opt int) error {
+	return syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, opt, 1)
+}
@@ -0,0 +1,9 @@
+//go:build !unix
+
+package main
+
+import "os"
+
+// notifyToggle does nothing where there is no SIGUSR1; maintenance mode
+// can only be set at startup there.
+func notifyToggle(c chan<- os.Signal) {}
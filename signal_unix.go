@@ -0,0 +1,14 @@
+//go:build unix
+
+package main
+
+import (
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+// notifyToggle relays SIGUSR1, which flips maintenance mode, to c.
+func notifyToggle(c chan<- os.Signal) {
+	signal.Notify(c, syscall.SIGUSR1)
+}